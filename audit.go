@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"force-rebase-11167/autoid"
+)
+
+// auditEntry is the record of a single executed ALTER statement.
+type auditEntry struct {
+	Time     time.Time `json:"time"`
+	Schema   string    `json:"schema"`
+	Table    string    `json:"table"`
+	OldValue *int64    `json:"old_value"` // nil if it could not be read
+	NewValue int64     `json:"new_value"`
+	Success  bool      `json:"success"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// auditLog appends an auditEntry per executed ALTER statement to a JSON Lines
+// file, syncing after each write so no record is lost on a crash.
+type auditLog struct {
+	f *os.File
+}
+
+// openAuditLog opens the audit log file for appending.
+func openAuditLog(path string) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening audit log: %w", err)
+	}
+	return &auditLog{f: f}, nil
+}
+
+// record writes the outcome of rebasing the table from the old value.
+func (a *auditLog) record(t *autoid.TableInfo, oldValue *int64, rebaseErr error) error {
+	entry := auditEntry{
+		Time:     time.Now(),
+		Schema:   t.Schema,
+		Table:    t.Table,
+		OldValue: oldValue,
+		NewValue: t.AutoInc,
+		Success:  rebaseErr == nil,
+	}
+	if rebaseErr != nil {
+		entry.Error = rebaseErr.Error()
+	}
+	line, err := json.Marshal(&entry)
+	if err != nil {
+		return fmt.Errorf("encoding audit entry: %w", err)
+	}
+	if _, err := a.f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("writing audit log: %w", err)
+	}
+	if err := a.f.Sync(); err != nil {
+		return fmt.Errorf("syncing audit log: %w", err)
+	}
+	return nil
+}
+
+// close closes the audit log file.
+func (a *auditLog) close() error {
+	return a.f.Close()
+}
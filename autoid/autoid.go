@@ -0,0 +1,567 @@
+// Package autoid inspects and rebases the auto-generated IDs (_tidb_rowid,
+// AUTO_RANDOM and AUTO_INCREMENT) of TiDB tables.
+package autoid
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/go-sql-driver/mysql" // MySQL Driver
+	"golang.org/x/time/rate"
+)
+
+// TableName is a fully-qualified table name.
+type TableName struct {
+	Schema string
+	Table  string
+}
+
+// TableInfo is the fully-qualified table name + the calculated auto_increment value
+type TableInfo struct {
+	TableName
+	AutoInc int64
+	IDType  string
+}
+
+// Values of the ID_TYPE column in SHOW TABLE NEXT_ROW_ID that we support.
+const (
+	IDTypeRowID         = "_TIDB_ROWID"
+	IDTypeAutoRandom    = "AUTO_RANDOM"
+	IDTypeAutoIncrement = "AUTO_INCREMENT"
+)
+
+// ShardingInfoPrefixes maps each ID type to the prefix of
+// information_schema.tables.tidb_row_id_sharding_info describing its shard bits.
+var ShardingInfoPrefixes = map[string]string{
+	IDTypeRowID:         "SHARD_BITS=",
+	IDTypeAutoRandom:    "PK_AUTO_RANDOM_BITS=",
+	IDTypeAutoIncrement: "", // AUTO_INCREMENT columns are never sharded
+}
+
+// Statuses of a CompareResult.
+const (
+	StatusOK      = "ok"
+	StatusError   = "ERROR"
+	StatusNoRowID = "no-rowid" // the table has no NEXT_ROW_ID of its ID type
+	StatusHigh    = "HIGH"     // the base is suspiciously far above the expected value
+)
+
+// CompareResult is the comparison between the expected and current
+// NEXT_GLOBAL_ROW_ID of a table.
+type CompareResult struct {
+	Schema   string `json:"schema"`
+	Table    string `json:"table"`
+	Expected int64  `json:"expected"`
+	Current  int64  `json:"current"`
+	Status   string `json:"status"`
+	// Drift is how the result changed since a previous run, if compared.
+	Drift string `json:"drift,omitempty"`
+}
+
+// Querier is the subset of *sql.DB used by the Client, so it can be run
+// against a mocked database.
+type Querier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// Constant for the specific MySQL error code we want to ignore.
+var unknownColumnError = &mysql.MySQLError{Number: 1054}
+
+// noSuchTableError is returned when the table was dropped during the run.
+var noSuchTableError = &mysql.MySQLError{Number: 1146}
+
+// ErrTableNotExist is returned by MaxRowID when the table does not exist,
+// e.g. it was dropped after the tables were listed.
+var ErrTableNotExist = errors.New("table does not exist")
+
+// ErrNoIDColumn is returned by MaxRowID in StrictRowID mode when the table
+// does not have the ID column.
+var ErrNoIDColumn = errors.New("table has no ID column")
+
+// MySQL error codes returned by TiDB versions not supporting a statement.
+var (
+	parseError        = &mysql.MySQLError{Number: 1064}
+	notSupportedError = &mysql.MySQLError{Number: 1235}
+)
+
+// Client runs the queries inspecting and rebasing the tables.
+type Client struct {
+	DB Querier
+	// FastMax makes MaxRowID read the last ID in descending order, which can
+	// use a reverse index scan instead of scanning the whole table. It assumes
+	// the IDs are monotonic, i.e. no IDs were allocated beyond the max.
+	FastMax bool
+	// Limiter throttles the MaxRowID calls and the rebased tables if not nil.
+	Limiter *rate.Limiter
+	// SchemaLimiters replaces the Limiter for the tables of the listed schemas.
+	// A nil entry leaves the schema unthrottled.
+	SchemaLimiters map[string]*rate.Limiter
+	// Tolerance is how far below the expected value the NEXT_GLOBAL_ROW_ID
+	// may be for Compare to still report it as ok.
+	Tolerance int64
+	// GapThreshold, if positive, is how far above the expected value the
+	// NEXT_GLOBAL_ROW_ID may be before Compare reports it as StatusHigh.
+	GapThreshold int64
+	// AsOf, if not empty, is the timestamp of the snapshot the max row IDs
+	// are read from with a stale read, in the `YYYY-MM-DD hh:mm:ss` format.
+	AsOf string
+	// StrictRowID makes MaxRowID fail with ErrNoIDColumn instead of returning
+	// 0 for a table without the ID column.
+	StrictRowID bool
+	// Explain makes MaxRowID and MaxRowIDs log the query plan of the max
+	// scans before running them.
+	Explain bool
+}
+
+// explain logs the plan of the query at info level, with how the table is
+// scanned: "reverse" if reading backwards from the end, "full" if reading the
+// whole table or index, or "range" otherwise. Failures are only logged.
+func (c *Client) explain(ctx context.Context, query string, attrs ...any) {
+	rows, err := c.DB.QueryContext(ctx, "EXPLAIN "+query)
+	if err != nil {
+		slog.Warn("Cannot explain the query", append(attrs, "error", err)...)
+		return
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		slog.Warn("Cannot explain the query", append(attrs, "error", err)...)
+		return
+	}
+	var plan strings.Builder
+	for rows.Next() {
+		values := make([]sql.NullString, len(cols))
+		dest := make([]any, len(cols))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			slog.Warn("Cannot explain the query", append(attrs, "error", err)...)
+			return
+		}
+		for i, v := range values {
+			if i != 0 {
+				plan.WriteByte('\t')
+			}
+			plan.WriteString(v.String)
+		}
+		plan.WriteByte('\n')
+	}
+	if err := rows.Err(); err != nil {
+		slog.Warn("Cannot explain the query", append(attrs, "error", err)...)
+		return
+	}
+
+	scan := "range"
+	switch p := plan.String(); {
+	case strings.Contains(p, "keep order:true, desc"):
+		scan = "reverse"
+	case strings.Contains(p, "FullScan"):
+		scan = "full"
+	}
+	slog.Info("Query plan", append(attrs, "scan", scan, "plan", plan.String())...)
+}
+
+// asOfClause returns the AS OF TIMESTAMP clause for reading from the AsOf
+// snapshot, or an empty string if not set.
+func (c *Client) asOfClause() string {
+	if c.AsOf == "" {
+		return ""
+	}
+	return fmt.Sprintf(" AS OF TIMESTAMP '%s'", strings.ReplaceAll(c.AsOf, "'", "''"))
+}
+
+// wait blocks until the limiter of the schema allows another operation.
+func (c *Client) wait(ctx context.Context, schemaName string) error {
+	limiter, ok := c.SchemaLimiters[schemaName]
+	if !ok {
+		limiter = c.Limiter
+	}
+	if limiter == nil {
+		return nil
+	}
+	return limiter.Wait(ctx)
+}
+
+// MaxRowID queries the maximum _tidb_rowid (or other ID column) for a
+// specific table, excluding the shard bits.
+func (c *Client) MaxRowID(ctx context.Context, schemaName, tableName, column string, shardRowIDBit uint64) (int64, error) {
+	if err := c.wait(ctx, schemaName); err != nil {
+		return 0, err
+	}
+
+	// The order of the IDs with shard bits does not follow the masked IDs, so
+	// the fast path only applies to unsharded tables.
+	if c.FastMax && shardRowIDBit == 0 {
+		maxID, err := c.fastMaxRowID(ctx, schemaName, tableName, column)
+		if err == nil || (unknownColumnError.Is(err) && !c.StrictRowID) {
+			return maxID, nil
+		}
+		slog.Debug("Falling back to full scan for max row ID", "schema", schemaName, "table", tableName, "error", err)
+	}
+
+	mask := (1 << (63 - shardRowIDBit)) - 1
+	query := fmt.Sprintf("SELECT coalesce(max(%s & %d), 0) FROM %s.%s%s", QuoteIdentifier(column), mask, QuoteIdentifier(schemaName), QuoteIdentifier(tableName), c.asOfClause())
+	if c.Explain {
+		c.explain(ctx, query, "schema", schemaName, "table", tableName)
+	}
+	var maxID int64
+	err := c.DB.QueryRowContext(ctx, query).Scan(&maxID)
+
+	if unknownColumnError.Is(err) {
+		if c.StrictRowID {
+			return 0, fmt.Errorf("%w: %s.%s has no %s", ErrNoIDColumn, QuoteIdentifier(schemaName), QuoteIdentifier(tableName), QuoteIdentifier(column))
+		}
+		return 0, nil // Ignore the unknown column error
+	}
+	if noSuchTableError.Is(err) {
+		return 0, fmt.Errorf("%w: %s.%s", ErrTableNotExist, QuoteIdentifier(schemaName), QuoteIdentifier(tableName))
+	}
+	return maxID, err
+}
+
+// MaxRowIDs queries the maximum ID column of multiple tables in the same
+// schema with a single UNION ALL query, excluding the shard bits of each table.
+// The whole query fails if any table lacks the column, in which case the
+// caller should fall back to MaxRowID.
+func (c *Client) MaxRowIDs(ctx context.Context, schemaName string, tableNames []string, column string, shardRowIDBits map[TableName]uint64) (map[string]int64, error) {
+	if err := c.wait(ctx, schemaName); err != nil {
+		return nil, err
+	}
+
+	var query strings.Builder
+	for i, tableName := range tableNames {
+		if i != 0 {
+			query.WriteString(" UNION ALL ")
+		}
+		mask := (1 << (63 - shardRowIDBits[TableName{Schema: schemaName, Table: tableName}])) - 1
+		fmt.Fprintf(&query, "SELECT %d, coalesce(max(%s & %d), 0) FROM %s.%s%s", i, QuoteIdentifier(column), mask, QuoteIdentifier(schemaName), QuoteIdentifier(tableName), c.asOfClause())
+	}
+
+	if c.Explain {
+		c.explain(ctx, query.String(), "schema", schemaName, "tables", len(tableNames))
+	}
+	rows, err := c.DB.QueryContext(ctx, query.String())
+	if err != nil {
+		return nil, fmt.Errorf("querying max row IDs of %d tables in schema '%s': %w", len(tableNames), schemaName, err)
+	}
+	defer rows.Close()
+
+	maxIDs := make(map[string]int64, len(tableNames))
+	for rows.Next() {
+		var index int
+		var maxID int64
+		if err := rows.Scan(&index, &maxID); err != nil {
+			return nil, fmt.Errorf("scanning max row ID row of schema '%s': %w", schemaName, err)
+		}
+		if index < 0 || index >= len(tableNames) {
+			return nil, fmt.Errorf("unexpected table index %d in max row IDs of schema '%s'", index, schemaName)
+		}
+		maxIDs[tableNames[index]] = maxID
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating max row ID rows of schema '%s': %w", schemaName, err)
+	}
+
+	return maxIDs, nil
+}
+
+// HasRowID probes whether the table has a _tidb_rowid, which is missing from
+// tables with a clustered primary key.
+func (c *Client) HasRowID(ctx context.Context, schemaName, tableName string) (bool, error) {
+	if err := c.wait(ctx, schemaName); err != nil {
+		return false, err
+	}
+	query := fmt.Sprintf("SELECT _tidb_rowid FROM %s.%s LIMIT 0", QuoteIdentifier(schemaName), QuoteIdentifier(tableName))
+	rows, err := c.DB.QueryContext(ctx, query)
+	if unknownColumnError.Is(err) {
+		return false, nil
+	}
+	if noSuchTableError.Is(err) {
+		return false, fmt.Errorf("%w: %s.%s", ErrTableNotExist, QuoteIdentifier(schemaName), QuoteIdentifier(tableName))
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, rows.Close()
+}
+
+// fastMaxRowID reads the last ID of the table in descending order. Returns 0
+// if the table is empty.
+func (c *Client) fastMaxRowID(ctx context.Context, schemaName, tableName, column string) (int64, error) {
+	query := fmt.Sprintf("SELECT %[1]s FROM %[2]s.%[3]s%[4]s ORDER BY %[1]s DESC LIMIT 1", QuoteIdentifier(column), QuoteIdentifier(schemaName), QuoteIdentifier(tableName), c.asOfClause())
+	if c.Explain {
+		c.explain(ctx, query, "schema", schemaName, "table", tableName, "fast_max", true)
+	}
+	var maxID int64
+	err := c.DB.QueryRowContext(ctx, query).Scan(&maxID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return maxID, err
+}
+
+// Rebase sets the AUTO_INCREMENT (or AUTO_RANDOM_BASE) of the tables. Multiple
+// tables are rebased in a single multi-statement round trip, where the server
+// stops at the first failing statement. If dryRun is true, the statements are
+// only logged and not executed.
+func (c *Client) Rebase(ctx context.Context, ts []TableInfo, dryRun bool) error {
+	queries := make([]string, len(ts))
+	for i := range ts {
+		queries[i] = RebaseStatement(&ts[i])
+		slog.Info("Rebasing", "sql", queries[i]+";")
+	}
+	if dryRun {
+		return nil
+	}
+	// Each table of the batch takes its own share of its schema's rate.
+	for i := range ts {
+		if err := c.wait(ctx, ts[i].Schema); err != nil {
+			return err
+		}
+	}
+	if _, err := c.DB.ExecContext(ctx, strings.Join(queries, ";\n")); err != nil {
+		if len(ts) == 1 {
+			return fmt.Errorf("rebasing %s.%s: %w", ts[0].Schema, ts[0].Table, err)
+		}
+		return fmt.Errorf("rebasing batch of %d tables from %s.%s: %w", len(ts), ts[0].Schema, ts[0].Table, err)
+	}
+	return nil
+}
+
+// QuoteIdentifier quotes a schema, table or column name with backticks,
+// doubling any backtick inside.
+func QuoteIdentifier(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// RebaseStatement returns the ALTER TABLE statement rebasing the table.
+func RebaseStatement(t *TableInfo) string {
+	option := "AUTO_INCREMENT"
+	if t.IDType == IDTypeAutoRandom {
+		option = "AUTO_RANDOM_BASE"
+	}
+	return fmt.Sprintf("ALTER TABLE %s.%s %s = %d", QuoteIdentifier(t.Schema), QuoteIdentifier(t.Table), option, t.AutoInc)
+}
+
+// Compare reads the current NEXT_GLOBAL_ROW_ID of the table and compares it
+// against the expected value. The status is StatusNoRowID if the table has no
+// NEXT_ROW_ID of its ID type.
+func (c *Client) Compare(ctx context.Context, t *TableInfo) (*CompareResult, error) {
+	nextGlobalRowID, found, err := c.NextGlobalRowID(ctx, t)
+	if errors.Is(err, parseError) || errors.Is(err, notSupportedError) {
+		slog.Debug("SHOW TABLE NEXT_ROW_ID is unsupported, falling back to information_schema", "schema", t.Schema, "table", t.Table, "error", err)
+		nextGlobalRowID, found, err = c.infoSchemaAutoIncrement(ctx, t)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return newNoRowIDResult(t), nil
+	}
+
+	return c.CompareCurrent(t, nextGlobalRowID), nil
+}
+
+// newNoRowIDResult reports that the table has no NEXT_ROW_ID of its ID type.
+func newNoRowIDResult(t *TableInfo) *CompareResult {
+	return &CompareResult{
+		Schema:   t.Schema,
+		Table:    t.Table,
+		Expected: t.AutoInc,
+		Status:   StatusNoRowID,
+	}
+}
+
+// CompareCurrent compares the given current NEXT_GLOBAL_ROW_ID of the table
+// against the expected value, accepting a shortfall up to the Tolerance.
+func (c *Client) CompareCurrent(t *TableInfo, current int64) *CompareResult {
+	var status string
+	switch {
+	case current < t.AutoInc-c.Tolerance:
+		status = StatusError
+	case c.GapThreshold > 0 && current-t.AutoInc > c.GapThreshold:
+		status = StatusHigh
+	default:
+		status = StatusOK
+	}
+	return &CompareResult{
+		Schema:   t.Schema,
+		Table:    t.Table,
+		Expected: t.AutoInc,
+		Current:  current,
+		Status:   status,
+	}
+}
+
+// infoSchemaAutoIncrement reads the AUTO_INCREMENT of the table from
+// information_schema.tables, for TiDB versions without SHOW TABLE NEXT_ROW_ID.
+// The returned bool is false if the table has no AUTO_INCREMENT value.
+func (c *Client) infoSchemaAutoIncrement(ctx context.Context, t *TableInfo) (int64, bool, error) {
+	var autoInc sql.NullInt64
+	err := c.DB.QueryRowContext(ctx, "SELECT auto_increment FROM information_schema.tables WHERE table_schema = ? AND table_name = ?", t.Schema, t.Table).Scan(&autoInc)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("querying auto_increment for %s.%s: %w", t.Schema, t.Table, err)
+	}
+	return autoInc.Int64, autoInc.Valid, nil
+}
+
+// Version reads the TiDB version, or the MySQL-compatible version if the
+// server does not support tidb_version().
+func (c *Client) Version(ctx context.Context) (string, error) {
+	version, err := c.TiDBVersion(ctx)
+	if err != nil {
+		err = c.DB.QueryRowContext(ctx, "SELECT @@version").Scan(&version)
+	}
+	if err != nil {
+		return "", fmt.Errorf("querying version: %w", err)
+	}
+	return version, nil
+}
+
+// TiDBVersion reads the output of tidb_version(), which fails if the server is
+// not TiDB.
+func (c *Client) TiDBVersion(ctx context.Context) (string, error) {
+	var version string
+	if err := c.DB.QueryRowContext(ctx, "SELECT tidb_version()").Scan(&version); err != nil {
+		return "", fmt.Errorf("querying tidb_version(): %w", err)
+	}
+	return version, nil
+}
+
+// Grants reads the privileges granted to the current user.
+func (c *Client) Grants(ctx context.Context) ([]string, error) {
+	rows, err := c.DB.QueryContext(ctx, "SHOW GRANTS")
+	if err != nil {
+		return nil, fmt.Errorf("querying grants: %w", err)
+	}
+	defer rows.Close()
+
+	var grants []string
+	for rows.Next() {
+		var grant string
+		if err := rows.Scan(&grant); err != nil {
+			return nil, fmt.Errorf("scanning grant: %w", err)
+		}
+		grants = append(grants, grant)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating grants: %w", err)
+	}
+
+	return grants, nil
+}
+
+// ReadOnly checks if the server rejects writes, through either
+// tidb_super_read_only (absent in older TiDB versions) or read_only.
+func (c *Client) ReadOnly(ctx context.Context) (bool, error) {
+	var superReadOnly bool
+	if err := c.DB.QueryRowContext(ctx, "SELECT @@global.tidb_super_read_only").Scan(&superReadOnly); err == nil && superReadOnly {
+		return true, nil
+	}
+	var readOnly bool
+	if err := c.DB.QueryRowContext(ctx, "SELECT @@global.read_only").Scan(&readOnly); err != nil {
+		return false, fmt.Errorf("querying read_only: %w", err)
+	}
+	return readOnly, nil
+}
+
+// Verify checks that the NEXT_GLOBAL_ROW_ID of the table has reached the
+// expected value after a rebase.
+func (c *Client) Verify(ctx context.Context, t *TableInfo) error {
+	nextGlobalRowID, found, err := c.NextGlobalRowID(ctx, t)
+	if err != nil {
+		return fmt.Errorf("verifying rebase: %w", err)
+	}
+	if !found {
+		return fmt.Errorf("verifying rebase: no %s row in output of SHOW TABLE NEXT_ROW_ID for '%s.%s'", t.IDType, t.Schema, t.Table)
+	}
+	if nextGlobalRowID < t.AutoInc {
+		return fmt.Errorf("verifying rebase: requested %d but NEXT_GLOBAL_ROW_ID of '%s.%s' is %d", t.AutoInc, t.Schema, t.Table, nextGlobalRowID)
+	}
+	return nil
+}
+
+// NextGlobalRowID reads the NEXT_GLOBAL_ROW_ID of the table for its ID type.
+// The returned bool is false if SHOW TABLE NEXT_ROW_ID has no row of that type.
+func (c *Client) NextGlobalRowID(ctx context.Context, t *TableInfo) (int64, bool, error) {
+	query := fmt.Sprintf("SHOW TABLE %s.%s NEXT_ROW_ID", QuoteIdentifier(t.Schema), QuoteIdentifier(t.Table))
+	// perform the query and iterate the resultset, compare if the column `ID_TYPE` has the value of t.IDType. if yes, read the value in the `NEXT_GLOBAL_ROW_ID` column.
+	rows, err := c.DB.QueryContext(ctx, query)
+	if err != nil {
+		return 0, false, fmt.Errorf("querying NEXT_ROW_ID for %s.%s: %w", t.Schema, t.Table, err)
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return 0, false, fmt.Errorf("getting columns for next row id query '%s.%s': %w", t.Schema, t.Table, err)
+	}
+
+	// Find indices of required columns
+	idTypeIndex := -1
+	nextIDIndex := -1
+	for i, colName := range cols {
+		// Case-insensitive comparison ignoring underscores, since the spelling
+		// differs across TiDB versions (e.g. NEXT_GLOBAL_ROWID)
+		switch strings.ReplaceAll(strings.ToUpper(colName), "_", "") {
+		case "IDTYPE":
+			idTypeIndex = i
+		case "NEXTGLOBALROWID":
+			nextIDIndex = i
+		}
+	}
+	if idTypeIndex == -1 || nextIDIndex == -1 {
+		return 0, false, fmt.Errorf("required columns 'ID_TYPE' or 'NEXT_GLOBAL_ROW_ID' not found in output of SHOW TABLE NEXT_ROW_ID for '%s.%s'", t.Schema, t.Table)
+	}
+
+	// Create slices for scanning row data
+	scanArgs := make([]interface{}, len(cols))
+	for i := range scanArgs {
+		switch i {
+		case idTypeIndex:
+			scanArgs[i] = new(string)
+		case nextIDIndex:
+			scanArgs[i] = new(int64)
+		default:
+			scanArgs[i] = new(sql.RawBytes)
+		}
+	}
+
+	// All rows are read to log how many matched, which tells an empty output
+	// apart from one without the ID type. The first match is used.
+	var nextGlobalRowID int64
+	total, matched := 0, 0
+	for rows.Next() {
+		if err := rows.Scan(scanArgs...); err != nil {
+			return 0, false, fmt.Errorf("scanning row for schema '%s' table '%s': %w", t.Schema, t.Table, err)
+		}
+		total++
+
+		if *(scanArgs[idTypeIndex].(*string)) == t.IDType {
+			if matched == 0 {
+				nextGlobalRowID = *(scanArgs[nextIDIndex].(*int64))
+			}
+			matched++
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return 0, false, fmt.Errorf("iterating next row id results for '%s.%s': %w", t.Schema, t.Table, err)
+	}
+
+	slog.Debug("Read SHOW TABLE NEXT_ROW_ID", "schema", t.Schema, "table", t.Table, "id_type", t.IDType, "rows", total, "matched", matched)
+	return nextGlobalRowID, matched > 0, nil
+}
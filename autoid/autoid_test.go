@@ -0,0 +1,408 @@
+package autoid
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+	"golang.org/x/time/rate"
+)
+
+// listTables collects the names yielded by Client.Tables, stopping at the
+// first error.
+func listTables(client *Client, schema string) ([]string, error) {
+	var tables []string
+	for table, err := range client.Tables(context.Background(), schema) {
+		if err != nil {
+			return tables, err
+		}
+		tables = append(tables, table)
+	}
+	return tables, nil
+}
+
+// newMockClient returns a Client over a mocked database matching the queries
+// exactly, checking that every expected query was run once the test ends.
+func newMockClient(t *testing.T) (*Client, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("creating mock database: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("unmet expectations: %v", err)
+		}
+		db.Close()
+	})
+	return &Client{DB: db}, mock
+}
+
+func TestTables(t *testing.T) {
+	tests := []struct {
+		name    string
+		expect  func(*sqlmock.ExpectedQuery)
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "tables",
+			expect: func(q *sqlmock.ExpectedQuery) {
+				q.WillReturnRows(sqlmock.NewRows([]string{"Tables_in_db"}).AddRow("t1").AddRow("t2"))
+			},
+			want: []string{"t1", "t2"},
+		},
+		{
+			name: "empty schema",
+			expect: func(q *sqlmock.ExpectedQuery) {
+				q.WillReturnRows(sqlmock.NewRows([]string{"Tables_in_db"}))
+			},
+		},
+		{
+			name: "scan error",
+			expect: func(q *sqlmock.ExpectedQuery) {
+				q.WillReturnRows(sqlmock.NewRows([]string{"Tables_in_db"}).AddRow(nil))
+			},
+			wantErr: true,
+		},
+		{
+			name: "unknown database",
+			expect: func(q *sqlmock.ExpectedQuery) {
+				q.WillReturnError(&mysql.MySQLError{Number: 1049, Message: "Unknown database 'db'"})
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, mock := newMockClient(t)
+			tt.expect(mock.ExpectQuery("SHOW TABLES FROM `db`"))
+
+			tables, err := listTables(client, "db")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Tables = %v, want an error", tables)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Tables: %v", err)
+			}
+			if !slices.Equal(tables, tt.want) {
+				t.Errorf("Tables = %v, want %v", tables, tt.want)
+			}
+		})
+	}
+}
+
+func TestTablesMixedCase(t *testing.T) {
+	client, mock := newMockClient(t)
+	mock.ExpectQuery("SHOW TABLES FROM `db`").
+		WillReturnRows(sqlmock.NewRows([]string{"Tables_in_db"}).AddRow("Foo").AddRow("foo").AddRow("Bar"))
+	mock.ExpectQuery("SELECT coalesce(max(`_tidb_rowid` & 9223372036854775807), 0) FROM `db`.`Foo`").
+		WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(10))
+
+	tables, err := listTables(client, "db")
+	if err != nil {
+		t.Fatalf("Tables: %v", err)
+	}
+	// foo refers to the same table as Foo, and the names keep their case.
+	if want := []string{"Foo", "Bar"}; !slices.Equal(tables, want) {
+		t.Fatalf("Tables = %v, want %v", tables, want)
+	}
+	if _, err := client.MaxRowID(context.Background(), "db", tables[0], "_tidb_rowid", 0); err != nil {
+		t.Fatalf("MaxRowID: %v", err)
+	}
+}
+
+func TestMaxRowID(t *testing.T) {
+	const query = "SELECT coalesce(max(`_tidb_rowid` & 9223372036854775807), 0) FROM `db`.`t`"
+
+	tests := []struct {
+		name    string
+		strict  bool
+		expect  func(*sqlmock.ExpectedQuery)
+		want    int64
+		wantErr error // nil if no error is expected
+		anyErr  bool  // an error is expected without a sentinel to match
+	}{
+		{
+			name: "max",
+			expect: func(q *sqlmock.ExpectedQuery) {
+				q.WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(42))
+			},
+			want: 42,
+		},
+		{
+			name: "empty table",
+			expect: func(q *sqlmock.ExpectedQuery) {
+				q.WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(0))
+			},
+			want: 0,
+		},
+		{
+			name: "unknown column",
+			expect: func(q *sqlmock.ExpectedQuery) {
+				q.WillReturnError(&mysql.MySQLError{Number: 1054, Message: "Unknown column '_tidb_rowid'"})
+			},
+			want: 0,
+		},
+		{
+			name:   "unknown column with StrictRowID",
+			strict: true,
+			expect: func(q *sqlmock.ExpectedQuery) {
+				q.WillReturnError(&mysql.MySQLError{Number: 1054, Message: "Unknown column '_tidb_rowid'"})
+			},
+			wantErr: ErrNoIDColumn,
+		},
+		{
+			name: "table not exist",
+			expect: func(q *sqlmock.ExpectedQuery) {
+				q.WillReturnError(&mysql.MySQLError{Number: 1146, Message: "Table 'db.t' doesn't exist"})
+			},
+			wantErr: ErrTableNotExist,
+		},
+		{
+			name: "scan error",
+			expect: func(q *sqlmock.ExpectedQuery) {
+				q.WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow("not a number"))
+			},
+			anyErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, mock := newMockClient(t)
+			client.StrictRowID = tt.strict
+			tt.expect(mock.ExpectQuery(query))
+
+			got, err := client.MaxRowID(context.Background(), "db", "t", "_tidb_rowid", 0)
+			switch {
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("MaxRowID error = %v, want %v", err, tt.wantErr)
+				}
+			case tt.anyErr:
+				if err == nil {
+					t.Fatalf("MaxRowID = %d, want an error", got)
+				}
+			case err != nil:
+				t.Fatalf("MaxRowID: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("MaxRowID = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaxRowIDShardBits(t *testing.T) {
+	client, mock := newMockClient(t)
+	mock.ExpectQuery("SELECT coalesce(max(`_tidb_rowid` & 576460752303423487), 0) FROM `db`.`t`").
+		WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(7))
+
+	got, err := client.MaxRowID(context.Background(), "db", "t", "_tidb_rowid", 4)
+	if err != nil {
+		t.Fatalf("MaxRowID: %v", err)
+	}
+	if got != 7 {
+		t.Errorf("MaxRowID = %d, want 7", got)
+	}
+}
+
+func TestRebase(t *testing.T) {
+	t1 := TableInfo{TableName: TableName{Schema: "db", Table: "t1"}, AutoInc: 101, IDType: IDTypeRowID}
+	t2 := TableInfo{TableName: TableName{Schema: "db", Table: "t2"}, AutoInc: 202, IDType: IDTypeAutoRandom}
+
+	t.Run("single", func(t *testing.T) {
+		client, mock := newMockClient(t)
+		mock.ExpectExec("ALTER TABLE `db`.`t1` AUTO_INCREMENT = 101").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		if err := client.Rebase(context.Background(), []TableInfo{t1}, false); err != nil {
+			t.Fatalf("Rebase: %v", err)
+		}
+	})
+
+	t.Run("exec error", func(t *testing.T) {
+		client, mock := newMockClient(t)
+		execErr := &mysql.MySQLError{Number: 1142, Message: "ALTER command denied"}
+		mock.ExpectExec("ALTER TABLE `db`.`t1` AUTO_INCREMENT = 101").WillReturnError(execErr)
+		if err := client.Rebase(context.Background(), []TableInfo{t1}, false); !errors.Is(err, execErr) {
+			t.Fatalf("Rebase error = %v, want %v", err, execErr)
+		}
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		client, mock := newMockClient(t)
+		mock.ExpectExec("ALTER TABLE `db`.`t1` AUTO_INCREMENT = 101;\nALTER TABLE `db`.`t2` AUTO_RANDOM_BASE = 202").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		if err := client.Rebase(context.Background(), []TableInfo{t1, t2}, false); err != nil {
+			t.Fatalf("Rebase: %v", err)
+		}
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		// No statement is expected, so executing one fails the test.
+		client, _ := newMockClient(t)
+		if err := client.Rebase(context.Background(), []TableInfo{t1, t2}, true); err != nil {
+			t.Fatalf("Rebase: %v", err)
+		}
+	})
+
+	t.Run("batch across schemas", func(t *testing.T) {
+		// The limiter of the second schema never allows a rebase, so the batch
+		// must not be executed on the budget of the first schema alone.
+		client, _ := newMockClient(t)
+		client.SchemaLimiters = map[string]*rate.Limiter{"other": rate.NewLimiter(1, 0)}
+		t3 := TableInfo{TableName: TableName{Schema: "other", Table: "t3"}, AutoInc: 303, IDType: IDTypeRowID}
+		// No statement is expected, and an executed batch fails with a
+		// "rebasing batch" error instead of the limiter's.
+		err := client.Rebase(context.Background(), []TableInfo{t1, t3}, false)
+		if err == nil || strings.Contains(err.Error(), "rebasing") {
+			t.Fatalf("Rebase error = %v, want the limiter of the other schema to fail it", err)
+		}
+	})
+}
+
+func TestCompare(t *testing.T) {
+	const query = "SHOW TABLE `db`.`t` NEXT_ROW_ID"
+	columns := []string{"DB_NAME", "TABLE_NAME", "COLUMN_NAME", "NEXT_GLOBAL_ROW_ID", "ID_TYPE"}
+
+	tests := []struct {
+		name      string
+		columns   []string
+		rows      [][]driver.Value
+		queryErr  error
+		tolerance int64
+		gap       int64
+		want      string // the expected status, or empty if an error is expected
+		current   int64
+	}{
+		{
+			name:    "ok",
+			columns: columns,
+			rows:    [][]driver.Value{{"db", "t", "_tidb_rowid", 150, IDTypeRowID}},
+			want:    StatusOK,
+			current: 150,
+		},
+		{
+			name:    "below expected",
+			columns: columns,
+			rows:    [][]driver.Value{{"db", "t", "_tidb_rowid", 50, IDTypeRowID}},
+			want:    StatusError,
+			current: 50,
+		},
+		{
+			name:      "within tolerance",
+			columns:   columns,
+			rows:      [][]driver.Value{{"db", "t", "_tidb_rowid", 95, IDTypeRowID}},
+			tolerance: 5,
+			want:      StatusOK,
+			current:   95,
+		},
+		{
+			name:      "beyond tolerance",
+			columns:   columns,
+			rows:      [][]driver.Value{{"db", "t", "_tidb_rowid", 94, IDTypeRowID}},
+			tolerance: 5,
+			want:      StatusError,
+			current:   94,
+		},
+		{
+			name:    "above gap threshold",
+			columns: columns,
+			rows:    [][]driver.Value{{"db", "t", "_tidb_rowid", 1101, IDTypeRowID}},
+			gap:     1000,
+			want:    StatusHigh,
+			current: 1101,
+		},
+		{
+			name:    "within gap threshold",
+			columns: columns,
+			rows:    [][]driver.Value{{"db", "t", "_tidb_rowid", 1100, IDTypeRowID}},
+			gap:     1000,
+			want:    StatusOK,
+			current: 1100,
+		},
+		{
+			name:    "no matching ID type",
+			columns: columns,
+			rows:    [][]driver.Value{{"db", "t", "id", 150, IDTypeAutoIncrement}},
+			want:    StatusNoRowID,
+		},
+		{
+			name:    "column spelling of other versions",
+			columns: []string{"DB_NAME", "TABLE_NAME", "COLUMN_NAME", "NEXT_GLOBAL_ROWID", "ID_TYPE"},
+			rows:    [][]driver.Value{{"db", "t", "_tidb_rowid", 150, IDTypeRowID}},
+			want:    StatusOK,
+			current: 150,
+		},
+		{
+			name:    "no rows",
+			columns: columns,
+			want:    StatusNoRowID,
+		},
+		{
+			name:     "query error",
+			queryErr: &mysql.MySQLError{Number: 1146, Message: "Table 'db.t' doesn't exist"},
+		},
+		{
+			name:    "missing columns",
+			columns: []string{"DB_NAME", "TABLE_NAME", "COLUMN_NAME"},
+			rows:    [][]driver.Value{{"db", "t", "_tidb_rowid"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, mock := newMockClient(t)
+			client.Tolerance = tt.tolerance
+			client.GapThreshold = tt.gap
+			if tt.queryErr != nil {
+				mock.ExpectQuery(query).WillReturnError(tt.queryErr)
+			} else {
+				rows := sqlmock.NewRows(tt.columns)
+				for _, row := range tt.rows {
+					rows.AddRow(row...)
+				}
+				mock.ExpectQuery(query).WillReturnRows(rows)
+			}
+
+			table := &TableInfo{TableName: TableName{Schema: "db", Table: "t"}, AutoInc: 100, IDType: IDTypeRowID}
+			result, err := client.Compare(context.Background(), table)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("Compare = %+v, want an error", result)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Compare: %v", err)
+			}
+			if result.Status != tt.want || result.Current != tt.current || result.Expected != 100 {
+				t.Errorf("Compare = %+v, want status %s with current %d and expected 100", result, tt.want, tt.current)
+			}
+		})
+	}
+}
+
+func TestNextGlobalRowID(t *testing.T) {
+	client, mock := newMockClient(t)
+	mock.ExpectQuery("SHOW TABLE `db`.`t` NEXT_ROW_ID").
+		WillReturnRows(sqlmock.NewRows([]string{"DB_NAME", "TABLE_NAME", "COLUMN_NAME", "NEXT_GLOBAL_ROW_ID", "ID_TYPE"}).
+			AddRow("db", "t", "_tidb_rowid", 30001, IDTypeRowID).
+			AddRow("db", "t", "id", 1, IDTypeAutoRandom))
+
+	table := &TableInfo{TableName: TableName{Schema: "db", Table: "t"}, IDType: IDTypeAutoRandom}
+	current, found, err := client.NextGlobalRowID(context.Background(), table)
+	if err != nil {
+		t.Fatalf("NextGlobalRowID: %v", err)
+	}
+	if !found || current != 1 {
+		t.Errorf("NextGlobalRowID = %d, %t, want 1, true", current, found)
+	}
+}
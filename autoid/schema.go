@@ -0,0 +1,306 @@
+package autoid
+
+import (
+	"context"
+	"fmt"
+	"iter"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Tables yields the names of the tables within the schema as the rows are
+// read, without collecting them first, so the caller can start on the tables
+// of a huge schema right away. A failed listing yields the error last.
+func (c *Client) Tables(ctx context.Context, schemaName string) iter.Seq2[string, error] {
+	return func(yield func(string, error) bool) {
+		query := "SHOW TABLES FROM " + QuoteIdentifier(schemaName)
+		rows, err := c.DB.QueryContext(ctx, query)
+		if err != nil {
+			yield("", fmt.Errorf("querying tables for schema '%s': %w", schemaName, err))
+			return
+		}
+		defer rows.Close()
+
+		// The names are kept verbatim for the later queries. TiDB compares table
+		// names case-insensitively, so names differing only in case would refer
+		// to the same table, and only the first of them is yielded.
+		seen := make(map[string]string)
+		for rows.Next() {
+			var tableName string
+			if err := rows.Scan(&tableName); err != nil {
+				yield("", fmt.Errorf("scanning table name for schema '%s': %w", schemaName, err))
+				return
+			}
+			if first, ok := seen[strings.ToLower(tableName)]; ok {
+				slog.Warn("Skipping table name differing from another only in case", "schema", schemaName, "table", tableName, "kept", first)
+				continue
+			}
+			seen[strings.ToLower(tableName)] = tableName
+			if !yield(tableName, nil) {
+				return
+			}
+		}
+
+		if err := rows.Err(); err != nil {
+			yield("", fmt.Errorf("iterating table rows for schema '%s': %w", schemaName, err))
+		}
+	}
+}
+
+// Schemas retrieves the names of all schemas in the database.
+func (c *Client) Schemas(ctx context.Context) ([]string, error) {
+	rows, err := c.DB.QueryContext(ctx, "SELECT schema_name FROM information_schema.schemata")
+	if err != nil {
+		return nil, fmt.Errorf("querying schemas: %w", err)
+	}
+	defer rows.Close()
+
+	var schemas []string
+	for rows.Next() {
+		var schema string
+		if err := rows.Scan(&schema); err != nil {
+			return nil, fmt.Errorf("scanning schema name: %w", err)
+		}
+		schemas = append(schemas, schema)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating schema rows: %w", err)
+	}
+
+	return schemas, nil
+}
+
+// ShardRowIDBits reads the number of shard bits of every table in the
+// schemas whose tidb_row_id_sharding_info starts with the given prefix.
+func (c *Client) ShardRowIDBits(ctx context.Context, schemas []string, prefix string) (map[TableName]uint64, error) {
+	if len(schemas) == 0 {
+		return make(map[TableName]uint64), nil
+	}
+	placeholders, args := schemaListArgs(schemas)
+	query := fmt.Sprintf("select table_schema, table_name, cast(substr(tidb_row_id_sharding_info, %d) as unsigned) bits from information_schema.tables where table_schema in (%s) and tidb_row_id_sharding_info like concat(?, '%%')", len(prefix)+1, placeholders)
+
+	rows, err := c.DB.QueryContext(ctx, query, append(args, prefix)...)
+	if err != nil {
+		return nil, fmt.Errorf("querying shard_row_id_bits: %w", err)
+	}
+	defer rows.Close()
+
+	shardRowIDBits := make(map[TableName]uint64)
+	for rows.Next() {
+		var name TableName
+		var bits uint64
+		if err := rows.Scan(&name.Schema, &name.Table, &bits); err != nil {
+			return nil, fmt.Errorf("scanning shard_row_id_bits row: %w", err)
+		}
+		shardRowIDBits[name] = bits
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating shard_row_id_bits rows: %w", err)
+	}
+
+	return shardRowIDBits, nil
+}
+
+// PrimaryKeyColumns reads the first primary key column of every table in the
+// schemas.
+func (c *Client) PrimaryKeyColumns(ctx context.Context, schemas []string) (map[TableName]string, error) {
+	if len(schemas) == 0 {
+		return make(map[TableName]string), nil
+	}
+	placeholders, args := schemaListArgs(schemas)
+	query := fmt.Sprintf("select table_schema, table_name, column_name from information_schema.key_column_usage where table_schema in (%s) and constraint_name = 'PRIMARY' and ordinal_position = 1", placeholders)
+
+	rows, err := c.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying primary key columns: %w", err)
+	}
+	defer rows.Close()
+
+	columns := make(map[TableName]string)
+	for rows.Next() {
+		var name TableName
+		var column string
+		if err := rows.Scan(&name.Schema, &name.Table, &column); err != nil {
+			return nil, fmt.Errorf("scanning primary key column row: %w", err)
+		}
+		columns[name] = column
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating primary key column rows: %w", err)
+	}
+
+	return columns, nil
+}
+
+// AutoIncrementColumns reads the AUTO_INCREMENT column of every table in the
+// schemas.
+func (c *Client) AutoIncrementColumns(ctx context.Context, schemas []string) (map[TableName]string, error) {
+	if len(schemas) == 0 {
+		return make(map[TableName]string), nil
+	}
+	placeholders, args := schemaListArgs(schemas)
+	query := fmt.Sprintf("select table_schema, table_name, column_name from information_schema.columns where table_schema in (%s) and lower(extra) like '%%auto_increment%%'", placeholders)
+
+	rows, err := c.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying auto_increment columns: %w", err)
+	}
+	defer rows.Close()
+
+	columns := make(map[TableName]string)
+	for rows.Next() {
+		var name TableName
+		var column string
+		if err := rows.Scan(&name.Schema, &name.Table, &column); err != nil {
+			return nil, fmt.Errorf("scanning auto_increment column row: %w", err)
+		}
+		columns[name] = column
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating auto_increment column rows: %w", err)
+	}
+
+	return columns, nil
+}
+
+// PartitionedTables reads the set of partitioned tables in the schemas.
+func (c *Client) PartitionedTables(ctx context.Context, schemas []string) (map[TableName]struct{}, error) {
+	if len(schemas) == 0 {
+		return make(map[TableName]struct{}), nil
+	}
+	placeholders, args := schemaListArgs(schemas)
+	query := fmt.Sprintf("select distinct table_schema, table_name from information_schema.partitions where table_schema in (%s) and partition_name is not null", placeholders)
+
+	rows, err := c.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying partitioned tables: %w", err)
+	}
+	defer rows.Close()
+
+	tables := make(map[TableName]struct{})
+	for rows.Next() {
+		var name TableName
+		if err := rows.Scan(&name.Schema, &name.Table); err != nil {
+			return nil, fmt.Errorf("scanning partitioned table row: %w", err)
+		}
+		tables[name] = struct{}{}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating partitioned table rows: %w", err)
+	}
+
+	return tables, nil
+}
+
+// AutoIncrementValues reads the AUTO_INCREMENT value of every table in the
+// schemas from information_schema.tables in a single query. TiDB only fills
+// this value for tables with an AUTO_INCREMENT column, so the other tables are
+// absent from the result.
+func (c *Client) AutoIncrementValues(ctx context.Context, schemas []string) (map[TableName]int64, error) {
+	if len(schemas) == 0 {
+		return make(map[TableName]int64), nil
+	}
+	placeholders, args := schemaListArgs(schemas)
+	query := fmt.Sprintf("select table_schema, table_name, auto_increment from information_schema.tables where table_schema in (%s) and auto_increment is not null", placeholders)
+
+	rows, err := c.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying auto_increment values: %w", err)
+	}
+	defer rows.Close()
+
+	values := make(map[TableName]int64)
+	for rows.Next() {
+		var name TableName
+		var value int64
+		if err := rows.Scan(&name.Schema, &name.Table, &value); err != nil {
+			return nil, fmt.Errorf("scanning auto_increment value row: %w", err)
+		}
+		values[name] = value
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating auto_increment value rows: %w", err)
+	}
+
+	return values, nil
+}
+
+// ClusteredTables reads the set of tables with a clustered primary key in the
+// schemas, which have no _tidb_rowid.
+func (c *Client) ClusteredTables(ctx context.Context, schemas []string) (map[TableName]struct{}, error) {
+	if len(schemas) == 0 {
+		return make(map[TableName]struct{}), nil
+	}
+	placeholders, args := schemaListArgs(schemas)
+	query := fmt.Sprintf("select table_schema, table_name from information_schema.tables where table_schema in (%s) and tidb_pk_type = 'CLUSTERED'", placeholders)
+
+	rows, err := c.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying clustered tables: %w", err)
+	}
+	defer rows.Close()
+
+	tables := make(map[TableName]struct{})
+	for rows.Next() {
+		var name TableName
+		if err := rows.Scan(&name.Schema, &name.Table); err != nil {
+			return nil, fmt.Errorf("scanning clustered table row: %w", err)
+		}
+		tables[name] = struct{}{}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating clustered table rows: %w", err)
+	}
+
+	return tables, nil
+}
+
+// UpdateTimes reads the last update time of every table in the schemas. Tables
+// whose update time is unknown are absent from the result.
+func (c *Client) UpdateTimes(ctx context.Context, schemas []string) (map[TableName]time.Time, error) {
+	if len(schemas) == 0 {
+		return make(map[TableName]time.Time), nil
+	}
+	placeholders, args := schemaListArgs(schemas)
+	query := fmt.Sprintf("select table_schema, table_name, unix_timestamp(update_time) from information_schema.tables where table_schema in (%s) and update_time is not null", placeholders)
+
+	rows, err := c.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying update times: %w", err)
+	}
+	defer rows.Close()
+
+	updateTimes := make(map[TableName]time.Time)
+	for rows.Next() {
+		var name TableName
+		var unixTime float64
+		if err := rows.Scan(&name.Schema, &name.Table, &unixTime); err != nil {
+			return nil, fmt.Errorf("scanning update time row: %w", err)
+		}
+		updateTimes[name] = time.Unix(int64(unixTime), 0)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterating update time rows: %w", err)
+	}
+
+	return updateTimes, nil
+}
+
+// schemaListArgs returns the `?,?,...` placeholders of the schema names in an
+// IN list, together with the names as the query arguments.
+func schemaListArgs(schemas []string) (string, []any) {
+	args := make([]any, len(schemas))
+	for i, schema := range schemas {
+		args[i] = schema
+	}
+	return strings.TrimPrefix(strings.Repeat(",?", len(schemas)), ","), args
+}
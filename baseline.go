@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"force-rebase-11167/autoid"
+)
+
+// Drift statuses of a compare result against the -baseline.
+const (
+	driftNew       = "NEW"       // the table is absent from the baseline
+	driftChanged   = "CHANGED"   // the expected or current value differs from the baseline
+	driftResolved  = "RESOLVED"  // the table was not ok in the baseline but is now
+	driftUnchanged = "UNCHANGED" // the values are the same as the baseline
+)
+
+// baseline is a previous set of compare results, keyed by the table.
+type baseline map[autoid.TableName]autoid.CompareResult
+
+// readBaseline reads the compare results written by a previous run with
+// `-format json`, ignoring the summary line at the end.
+func readBaseline(path string) (baseline, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening baseline: %w", err)
+	}
+	defer f.Close()
+
+	b := make(baseline)
+	dec := json.NewDecoder(f)
+	for {
+		var r autoid.CompareResult
+		if err := dec.Decode(&r); errors.Is(err, io.EOF) {
+			return b, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("reading baseline: %w", err)
+		}
+		if r.Schema == "" && r.Table == "" {
+			continue // the summary line
+		}
+		b[autoid.TableName{Schema: r.Schema, Table: r.Table}] = r
+	}
+}
+
+// drift classifies how the result has changed since the baseline.
+func (b baseline) drift(r *autoid.CompareResult) string {
+	prev, ok := b[autoid.TableName{Schema: r.Schema, Table: r.Table}]
+	switch {
+	case !ok:
+		return driftNew
+	case prev.Status != autoid.StatusOK && r.Status == autoid.StatusOK:
+		return driftResolved
+	case prev.Expected != r.Expected || prev.Current != r.Current:
+		return driftChanged
+	default:
+		return driftUnchanged
+	}
+}
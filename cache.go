@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"force-rebase-11167/autoid"
+)
+
+// cacheStaleAfter is the age after which a loaded scan cache is warned about,
+// as the tables have likely received more rows since.
+const cacheStaleAfter = time.Hour
+
+// scanCache is the content of the -cache-file, holding the result of the
+// collection phase for reuse in a later run.
+type scanCache struct {
+	ScannedAt time.Time          `json:"scanned_at"`
+	Tables    []autoid.TableInfo `json:"tables"`
+}
+
+// writeScanCache saves the collected tables to the cache file.
+func writeScanCache(path string, scannedAt time.Time, tables []autoid.TableInfo) error {
+	content, err := json.MarshalIndent(&scanCache{ScannedAt: scannedAt, Tables: tables}, "", "\t")
+	if err != nil {
+		return fmt.Errorf("encoding cache: %w", err)
+	}
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		return fmt.Errorf("writing cache file: %w", err)
+	}
+	return nil
+}
+
+// readScanCache loads the tables collected by a previous run.
+func readScanCache(path string) (*scanCache, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading cache file: %w", err)
+	}
+	var cache scanCache
+	if err := json.Unmarshal(content, &cache); err != nil {
+		return nil, fmt.Errorf("parsing cache file: %w", err)
+	}
+	return &cache, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"force-rebase-11167/autoid"
+)
+
+// runCheck verifies that the server is TiDB, the user has the privileges
+// needed, and the server is writable, printing one status line per item.
+// Returns whether every item passed.
+func runCheck(ctx context.Context, client *autoid.Client, w io.Writer, address string) bool {
+	passed := true
+	report := func(item string, err error, detail string) {
+		if err != nil {
+			passed = false
+			fmt.Fprintf(w, "%-12s FAIL  %v\n", item, err)
+		} else {
+			fmt.Fprintf(w, "%-12s ok    %s\n", item, detail)
+		}
+	}
+
+	report("connection", nil, address)
+
+	version, err := client.TiDBVersion(ctx)
+	version, _, _ = strings.Cut(version, "\n")
+	report("tidb", err, version)
+
+	grants, err := client.Grants(ctx)
+	if err == nil {
+		err = checkGrants(grants)
+	}
+	report("privileges", err, "SELECT and ALTER")
+
+	readOnly, err := client.ReadOnly(ctx)
+	if err == nil && readOnly {
+		err = fmt.Errorf("server is read-only")
+	}
+	report("writable", err, "")
+
+	return passed
+}
+
+// checkGrants checks if the grants include both SELECT and ALTER, either
+// explicitly or through ALL PRIVILEGES. The grants are not matched against
+// specific schemas.
+func checkGrants(grants []string) error {
+	hasSelect, hasAlter := false, false
+	for _, grant := range grants {
+		grant = strings.ToUpper(grant)
+		if strings.Contains(grant, "ALL PRIVILEGES") {
+			return nil
+		}
+		hasSelect = hasSelect || strings.Contains(grant, "SELECT")
+		hasAlter = hasAlter || strings.Contains(grant, "ALTER")
+	}
+	if !hasSelect || !hasAlter {
+		return fmt.Errorf("missing SELECT or ALTER privilege in grants: %s", strings.Join(grants, "; "))
+	}
+	return nil
+}
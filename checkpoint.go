@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"force-rebase-11167/autoid"
+)
+
+// checkpoint records the tables already rebased in a file with one
+// `schema.table` per line, so an interrupted run can skip them on resume.
+type checkpoint struct {
+	f    *os.File
+	done map[autoid.TableName]struct{}
+}
+
+// openCheckpoint loads the tables listed in the checkpoint file and opens it
+// for appending. If reset is true, the existing content is discarded.
+func openCheckpoint(path string, reset bool) (*checkpoint, error) {
+	c := &checkpoint{done: make(map[autoid.TableName]struct{})}
+	if !reset {
+		content, err := os.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("reading checkpoint file: %w", err)
+		}
+		scanner := bufio.NewScanner(strings.NewReader(string(content)))
+		for scanner.Scan() {
+			schema, table, ok := strings.Cut(strings.TrimSpace(scanner.Text()), ".")
+			if !ok {
+				continue
+			}
+			c.done[autoid.TableName{Schema: schema, Table: table}] = struct{}{}
+		}
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if reset {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening checkpoint file: %w", err)
+	}
+	c.f = f
+	return c, nil
+}
+
+// has checks if the table was completed in a previous run.
+func (c *checkpoint) has(name autoid.TableName) bool {
+	_, ok := c.done[name]
+	return ok
+}
+
+// add records the table as completed.
+func (c *checkpoint) add(name autoid.TableName) error {
+	if _, err := fmt.Fprintf(c.f, "%s.%s\n", name.Schema, name.Table); err != nil {
+		return fmt.Errorf("writing checkpoint: %w", err)
+	}
+	return nil
+}
+
+// close closes the checkpoint file.
+func (c *checkpoint) close() error {
+	return c.f.Close()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// applyConfigFile reads a YAML file whose keys are flag names, and sets every
+// flag not explicitly given on the command line to the value in the file.
+// Lists are joined with commas, so e.g. `schemas: [a, b]` is equivalent to
+// `-schemas a,b`.
+func applyConfigFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+	var config map[string]any
+	if err := yaml.Unmarshal(content, &config); err != nil {
+		return fmt.Errorf("parsing config file: %w", err)
+	}
+
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	for name, value := range config {
+		if flag.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("unknown option '%s' in config file", name)
+		}
+		if explicit[name] {
+			continue
+		}
+		var s string
+		switch v := value.(type) {
+		case []any:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			s = strings.Join(items, ",")
+		case map[string]any:
+			return fmt.Errorf("option '%s' in config file must not be a mapping", name)
+		case nil:
+			continue
+		default:
+			s = fmt.Sprint(v)
+		}
+		if err := flag.Set(name, s); err != nil {
+			return fmt.Errorf("option '%s' in config file: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// defaultsFileOptions maps the options in the [client] section of a my.cnf
+// file to our flag names.
+var defaultsFileOptions = map[string]string{
+	"host":     "host",
+	"port":     "port",
+	"user":     "user",
+	"password": "password",
+	"socket":   "socket",
+	"database": "database",
+}
+
+// applyDefaultsFile reads the [client] section of a my.cnf-style file, and sets
+// the connection flags not explicitly given on the command line (or by
+// -config) to the values in the file.
+func applyDefaultsFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("opening defaults file: %w", err)
+	}
+	defer f.Close()
+
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	inClient := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			inClient = strings.TrimSpace(line[1:len(line)-1]) == "client"
+			continue
+		}
+		if !inClient {
+			continue
+		}
+		key, value, _ := strings.Cut(line, "=")
+		key = strings.ReplaceAll(strings.TrimSpace(key), "_", "-")
+		name, ok := defaultsFileOptions[key]
+		if !ok || explicit[name] {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("option '%s' in defaults file: %w", key, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading defaults file: %w", err)
+	}
+	return nil
+}
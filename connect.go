@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// hostAddresses builds the DSN address of every host in the comma-separated
+// list, all using the same port and protocol. IPv6 addresses are bracketed, and
+// may also be given already bracketed.
+func hostAddresses(hostList, port, protocol string) []string {
+	var addresses []string
+	for _, host := range strings.Split(hostList, ",") {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		addresses = append(addresses, fmt.Sprintf("%s(%s)", protocol, net.JoinHostPort(host, port)))
+	}
+	return addresses
+}
+
+// openFirstReachable connects to each address in turn, returning the first
+// database which responds to a ping within the timeout (0 means no timeout)
+// together with its address. dsnOf builds the DSN from the address. Every new
+// connection runs the initSQL statements first. If every address fails, all
+// errors are returned.
+func openFirstReachable(addresses []string, dsnOf func(address string) string, initSQL []string, timeout time.Duration) (*sql.DB, string, error) {
+	var errs []error
+	for _, address := range addresses {
+		db, err := openDB(dsnOf(address), initSQL)
+		if err == nil {
+			err = pingWithTimeout(db, timeout)
+			if err == nil {
+				return db, address, nil
+			}
+			db.Close()
+		}
+		slog.Warn("Cannot connect to host, trying the next one.", "address", address, "error", err)
+		errs = append(errs, fmt.Errorf("%s: %w", address, err))
+	}
+	if len(errs) == 0 {
+		return nil, "", errors.New("no hosts specified")
+	}
+	return nil, "", errors.Join(errs...)
+}
+
+// pingWithTimeout pings the database, giving up after the timeout if positive.
+func pingWithTimeout(db *sql.DB, timeout time.Duration) error {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return db.PingContext(ctx)
+}
+
+// openDB opens the database of the DSN, where every new connection runs the
+// initSQL statements first.
+func openDB(dsn string, initSQL []string) (*sql.DB, error) {
+	if len(initSQL) == 0 {
+		return sql.Open("mysql", dsn)
+	}
+	config, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	connector, err := mysql.NewConnector(config)
+	if err != nil {
+		return nil, err
+	}
+	return sql.OpenDB(initConnector{Connector: connector, initSQL: initSQL}), nil
+}
+
+// initConnector runs the initSQL statements on every new connection.
+type initConnector struct {
+	driver.Connector
+	initSQL []string
+}
+
+func (c initConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	execer, ok := conn.(driver.ExecerContext)
+	if !ok {
+		conn.Close()
+		return nil, errors.New("connection does not support executing -init-sql")
+	}
+	for _, stmt := range c.initSQL {
+		slog.Debug("Executing init statement", "sql", stmt)
+		if _, err := execer.ExecContext(ctx, stmt, nil); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("executing init statement '%s': %w", stmt, err)
+		}
+	}
+	return conn, nil
+}
+
+// parseInitSQL splits the semicolon-separated statements, dropping empty ones.
+func parseInitSQL(list string) []string {
+	var stmts []string
+	for _, stmt := range strings.Split(list, ";") {
+		if stmt = strings.TrimSpace(stmt); stmt != "" {
+			stmts = append(stmts, stmt)
+		}
+	}
+	return stmts
+}
@@ -0,0 +1,202 @@
+//go:build integration
+
+// Package integration runs the tool end to end against a TiDB server started
+// in Docker, checking the compare and rebase modes against the real SQL. Run
+// it with:
+//
+//	go test -tags integration ./...
+//
+// The test is skipped if Docker is not available.
+package integration
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"force-rebase-11167/autoid"
+
+	_ "github.com/go-sql-driver/mysql" // MySQL Driver
+	"github.com/ory/dockertest/v3"
+)
+
+// The TiDB server image to test against.
+const (
+	tidbImage = "pingcap/tidb"
+	tidbTag   = "v8.5.1"
+)
+
+// rowsPerTable is the number of rows inserted into each test table.
+const rowsPerTable = 100
+
+// testTables are the tables created for the test, with their schemas.
+var testTables = []autoid.TableName{
+	{Schema: "integration_a", Table: "t1"},
+	{Schema: "integration_a", Table: "t2"},
+	{Schema: "integration_b", Table: "t1"},
+}
+
+func TestRebase(t *testing.T) {
+	pool, err := dockertest.NewPool("")
+	if err == nil {
+		err = pool.Client.Ping()
+	}
+	if err != nil {
+		t.Skipf("Docker is not available: %v", err)
+	}
+	pool.MaxWait = 2 * time.Minute
+
+	resource, err := pool.Run(tidbImage, tidbTag, nil)
+	if err != nil {
+		t.Fatalf("starting TiDB: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := pool.Purge(resource); err != nil {
+			t.Logf("removing the TiDB container: %v", err)
+		}
+	})
+
+	port := resource.GetPort("4000/tcp")
+	var db *sql.DB
+	err = pool.Retry(func() (err error) {
+		db, err = sql.Open("mysql", fmt.Sprintf("root@tcp(127.0.0.1:%s)/", port))
+		if err != nil {
+			return err
+		}
+		return db.Ping()
+	})
+	if err != nil {
+		t.Fatalf("connecting to TiDB: %v", err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	if err := populate(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+
+	binary := buildTool(t)
+	args := []string{"-port", port, "-schemas", "integration_a,integration_b", "-format", "json"}
+
+	// The allocators were reset below the max row IDs, so all tables mismatch.
+	results, err := runCompare(binary, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := expectStatus(results, autoid.StatusError); err != nil {
+		t.Fatalf("before rebasing: %v", err)
+	}
+
+	if out, err := exec.Command(binary, append(args, "-mode", "rebase", "-yes")...).CombinedOutput(); err != nil {
+		t.Fatalf("running rebase mode: %v\n%s", err, out)
+	}
+
+	results, err = runCompare(binary, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := expectStatus(results, autoid.StatusOK); err != nil {
+		t.Fatalf("after rebasing: %v", err)
+	}
+
+	// Check the rebased allocators directly instead of trusting the tool.
+	client := &autoid.Client{DB: db}
+	for _, name := range testTables {
+		table := &autoid.TableInfo{TableName: name, AutoInc: rowsPerTable + 1, IDType: autoid.IDTypeRowID}
+		current, found, err := client.NextGlobalRowID(ctx, table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || current < table.AutoInc {
+			t.Fatalf("%s.%s was not rebased: NEXT_GLOBAL_ROW_ID is %d, expected at least %d", name.Schema, name.Table, current, table.AutoInc)
+		}
+	}
+}
+
+// buildTool builds the tool from the module root into a temporary directory,
+// returning the path to the binary.
+func buildTool(t *testing.T) string {
+	t.Helper()
+	gomod, err := exec.Command("go", "env", "GOMOD").Output()
+	if err != nil {
+		t.Fatalf("locating the module root: %v", err)
+	}
+	path := strings.TrimSpace(string(gomod))
+	if path == "" || path == os.DevNull {
+		t.Fatalf("the test is not run inside the module")
+	}
+	root := filepath.Dir(path)
+
+	binary := filepath.Join(t.TempDir(), "force-rebase-11167")
+	cmd := exec.Command("go", "build", "-o", binary, ".")
+	cmd.Dir = root
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("building the tool: %v\n%s", err, out)
+	}
+	return binary
+}
+
+// populate creates the test tables, fills them with rows, then resets their
+// row ID allocators to 1 to simulate the state after a physical import.
+func populate(ctx context.Context, db *sql.DB) error {
+	for _, name := range testTables {
+		statements := []string{
+			fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s`", name.Schema),
+			fmt.Sprintf("CREATE TABLE `%s`.`%s` (v INT)", name.Schema, name.Table),
+			fmt.Sprintf("INSERT INTO `%s`.`%s` WITH RECURSIVE seq(n) AS (SELECT 1 UNION ALL SELECT n + 1 FROM seq WHERE n < %d) SELECT n FROM seq", name.Schema, name.Table, rowsPerTable),
+			fmt.Sprintf("ALTER TABLE `%s`.`%s` FORCE AUTO_INCREMENT = 1", name.Schema, name.Table),
+		}
+		for _, statement := range statements {
+			if _, err := db.ExecContext(ctx, statement); err != nil {
+				return fmt.Errorf("populating %s.%s: %w", name.Schema, name.Table, err)
+			}
+		}
+	}
+	return nil
+}
+
+// runCompare runs the tool in compare mode and parses its JSON results.
+func runCompare(binary string, args []string) ([]autoid.CompareResult, error) {
+	cmd := exec.Command(binary, append(args, "-mode", "compare")...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("running compare mode: %w\n%s", err, stderr.Bytes())
+	}
+	var results []autoid.CompareResult
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		var r autoid.CompareResult
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("parsing compare result '%s': %w", scanner.Text(), err)
+		}
+		if r.Schema == "" && r.Table == "" {
+			continue // the summary line
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// expectStatus checks that every test table has a result of the status.
+func expectStatus(results []autoid.CompareResult, status string) error {
+	if len(results) != len(testTables) {
+		return fmt.Errorf("expected %d compare results, got %d: %+v", len(testTables), len(results), results)
+	}
+	for _, r := range results {
+		if r.Status != status {
+			return fmt.Errorf("expected status %s for %s.%s, got %+v", status, r.Schema, r.Table, r)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// setupLogger installs the default slog logger writing to stderr with the
+// given level (debug | info | warn | error) and format (text | json).
+func setupLogger(level, format string) error {
+	var opts slog.HandlerOptions
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level '%s'", level)
+	}
+	opts.Level = lvl
+
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, &opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, &opts)
+	default:
+		return fmt.Errorf("invalid log format '%s'", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// Exit statuses of the program.
+const (
+	exitOK             = 0 // success
+	exitGeneric        = 1 // invalid options, interruption, or any other error
+	exitConnection     = 2 // cannot connect to the database
+	exitPartialFailure = 3 // some schemas or tables failed
+	exitMismatch       = 4 // compare mismatches under -strict
+	exitTimeout        = 5 // -timeout reached
+)
+
+// exitStatusUsage documents the exit statuses in the usage text.
+const exitStatusUsage = `
+Exit statuses:
+  0  success
+  1  invalid options, interruption, or any other error
+  2  cannot connect to the database
+  3  some schemas or tables failed
+  4  some tables are reported as ERROR in compare mode with -strict
+  5  the -timeout was reached
+`
+
+// usage prints the flags and the exit statuses.
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage of %s:\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprint(out, exitStatusUsage)
+}
+
+// fatal logs the message at error level and exits with exitGeneric.
+func fatal(msg string, args ...any) {
+	fatalWithStatus(exitGeneric, msg, args...)
+}
+
+// fatalWithStatus logs the message at error level and exits with the status.
+func fatalWithStatus(status int, msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(status)
+}
+
+// exitCancelled logs why the run is stopped early and exits. A timeout exits
+// with exitTimeout, and an interruption by signal with exitGeneric.
+func exitCancelled(err error, msg string, args ...any) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		fatalWithStatus(exitTimeout, "Timed out. "+msg, args...)
+	}
+	fatal("Interrupted. "+msg, args...)
+}
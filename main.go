@@ -1,270 +1,823 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"maps"
+	"math"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
-	"github.com/go-sql-driver/mysql" // MySQL Driver
+	"force-rebase-11167/autoid"
+
+	_ "github.com/go-sql-driver/mysql" // MySQL Driver
+	"golang.org/x/time/rate"
 )
 
-type tableName struct {
-	Schema string
-	Table  string
+// parseTableList splits a comma-separated list of `schema.table` names,
+// returning the schemas in order of appearance and the tables of each schema.
+func parseTableList(list string) ([]string, map[string][]string, error) {
+	var schemas []string
+	tables := make(map[string][]string)
+	// TiDB compares the names case-insensitively, so entries differing only
+	// in case refer to the same table, and only the first of them is kept.
+	schemaSpellings := make(map[string]string)
+	seen := make(map[string]struct{})
+	for _, entry := range strings.Split(list, ",") {
+		parts := strings.Split(strings.TrimSpace(entry), ".")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, nil, fmt.Errorf("entry '%s' is not in the form 'schema.table'", entry)
+		}
+		key := strings.ToLower(parts[0] + "." + parts[1])
+		if _, ok := seen[key]; ok {
+			slog.Warn("Skipping duplicate -tables entry", "entry", entry)
+			continue
+		}
+		seen[key] = struct{}{}
+		schema, ok := schemaSpellings[strings.ToLower(parts[0])]
+		if !ok {
+			schema = parts[0]
+			schemaSpellings[strings.ToLower(schema)] = schema
+			schemas = append(schemas, schema)
+		}
+		tables[schema] = append(tables[schema], parts[1])
+	}
+	return schemas, tables, nil
 }
 
-// tableInfo is the fully-qualified table name + the calculated auto_increment value
-type tableInfo struct {
-	tableName
-	AutoInc int64
+// parseTablePatterns splits a comma-separated list of glob patterns, and
+// checks that every pattern is well-formed.
+func parseTablePatterns(list string) ([]string, error) {
+	var patterns []string
+	for _, pattern := range strings.Split(list, ",") {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("pattern '%s': %w", pattern, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
 }
 
-// Constant for the specific MySQL error code we want to ignore.
-var unknownColumnError = &mysql.MySQLError{Number: 1054}
+// matchesAny checks if `schema.table` matches any of the lower-cased glob
+// patterns.
+func matchesAny(n autoid.TableName, patterns []string) bool {
+	fullName := strings.ToLower(n.Schema + "." + n.Table)
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, fullName); matched {
+			return true
+		}
+	}
+	return false
+}
 
 const (
 	modeCompare = iota
 	modeRebase
+	modeRebaseIfNeeded
+	modePreflight
+	modeCheck
+	modeAuditRowID
+	modePlan
 )
 
+// overflowThreshold is the minimum headroom below math.MaxInt64 we require
+// above the max row ID. TiDB allocates IDs in batches, so a base too close to
+// the limit would soon exhaust the ID space anyway.
+const overflowThreshold = 1 << 20
+
 func main() {
 	// 1. Define and parse command-line flags
-	host := flag.String("host", "127.0.0.1", "Database host")
+	configFile := flag.String("config", "", "YAML file providing default values of the other flags, keyed by flag name")
+	defaultsFile := flag.String("defaults-file", "", "my.cnf-style file providing the host, port, user, password, socket and database in its [client] section")
+	logLevel := flag.String("log-level", "info", "Minimum level of log messages (debug | info | warn | error)")
+	logFormat := flag.String("log-format", "text", "Format of log messages (text | json)")
+	quiet := flag.Bool("quiet", false, "Only log warnings and errors, overriding -log-level")
+	verbose := flag.Bool("verbose", false, "Log every query sent to the database with its elapsed time")
+	verboseErrors := flag.Bool("verbose-errors", false, "Log the full SQL text with its arguments, the raw driver error and the stack of every failed query, except the errors falling back to another query which are only logged at debug level")
+	host := flag.String("host", "127.0.0.1", "Database host, or a comma-separated list of hosts to try in order until one is reachable")
 	port := flag.String("port", "4000", "Database port")
+	protocol := flag.String("protocol", "tcp", "Network protocol in the DSN to connect to -host with, e.g. a dial function registered for a proxy")
+	dsnParamString := flag.String("dsn-params", "", "Extra DSN parameters in URL query format, e.g. 'charset=utf8mb4&collation=utf8mb4_bin', overriding the ones set by the tool")
+	database := flag.String("database", "", "Default database of the connection, which is also the schema to process if no other schema is given")
+	socket := flag.String("socket", "", "Path to the Unix socket to connect to, overriding -host and -port")
+	connectTimeout := flag.Duration("connect-timeout", 10*time.Second, "Timeout of establishing the connection to each host (0 means no timeout)")
+	initSQL := flag.String("init-sql", "", "Semicolon-separated statements run on every new connection, e.g. to set session variables")
 	user := flag.String("user", "root", "Database username")
 	password := flag.String("password", "", "Database password")
-	modeString := flag.String("mode", "", "Mode of operation (compare | rebase)")
+	tlsCA := flag.String("tls-ca", "", "Path to the CA certificate used to verify the server")
+	tlsCert := flag.String("tls-cert", "", "Path to the client certificate (requires -tls-key)")
+	tlsKey := flag.String("tls-key", "", "Path to the client private key (requires -tls-cert)")
+	tlsSkipVerify := flag.Bool("tls-skip-verify", false, "Use TLS but skip verifying the server certificate")
+	passwordFile := flag.String("password-file", "", "File to read the database password from when -password is empty, e.g. a mounted secret")
+	passwordEnv := flag.String("password-env", "MYSQL_PWD", "Environment variable to read the database password from when -password is empty")
+	modeString := flag.String("mode", "", "Mode of operation (compare | rebase | rebase-if-needed | preflight | check | audit-rowid | plan | apply). Preflight only counts the tables to process in each schema. Check only verifies the connection, privileges and write access. Audit-rowid lists the tables without _tidb_rowid. Plan writes the intended rebases to the -plan file, which apply executes without scanning")
+	format := flag.String("format", "csv", "Output format of the compare results (csv | json | markdown)")
+	onlyErrors := flag.Bool("only-errors", false, "Only output the compare results with ERROR status, hiding the ok, no-rowid and HIGH ones (the summary still counts them)")
+	outputFile := flag.String("output", "", "File to write the compare results to (default: stdout)")
+	baselineFile := flag.String("baseline", "", "JSON compare results of a previous run, to report the drift of each table against (NEW, CHANGED, RESOLVED or UNCHANGED)")
+	tee := flag.Bool("tee", false, "Write the compare results to stdout as well as the -output file")
 	schemaList := flag.String("schemas", "", "Comma-separated list of schema names")
-
+	schemaRegex := flag.String("schema-regex", "", "Regular expression selecting the schemas to process, in addition to -schemas and -schemas-file")
+	allowSystemSchemas := flag.Bool("allow-system-schemas", false, "Process the system schemas (mysql, information_schema, etc.) if listed, instead of skipping them")
+	allSchemas := flag.Bool("all-schemas", false, "Process every schema except the system ones (conflicts with -schemas, -schemas-file and -tables)")
+	schemasFile := flag.String("schemas-file", "", "File listing schema names one per line, merged with -schemas")
+	planFile := flag.String("plan", "", "JSON file the plan mode writes the intended rebases to, and the apply mode reads them from")
+	cacheFile := flag.String("cache-file", "", "JSON file to save the collected max row IDs to, for reuse with -use-cache")
+	useCache := flag.Bool("use-cache", false, "Load the collected max row IDs from -cache-file instead of scanning the tables")
+	overridesFile := flag.String("overrides-file", "", "CSV file of `schema,table,value` rows giving the AUTO_INCREMENT values to use, skipping the max row ID scan")
+	tableList := flag.String("tables", "", "Comma-separated list of `schema.table` names to process exclusively (makes -schemas optional)")
+	tableRegex := flag.String("table-regex", "", "Regular expression the table names must match to be processed")
+	excludeTables := flag.String("exclude-tables", "", "Comma-separated list of glob patterns of `schema.table` names to skip (case-insensitive)")
+	shardGroupList := flag.String("shard-group", "", "Comma-separated list of 'name=pattern' shard groups, each finding the combined max row ID across the tables whose 'schema.table' matches the glob pattern")
+	shardGroupRebase := flag.Bool("shard-group-rebase", false, "Use the combined value of each -shard-group for all its tables, keeping the IDs unique across the shards")
+	schemaConcurrency := flag.Int("schema-concurrency", 1, "Number of schemas processed end to end at the same time, each listing, scanning then executing its own tables, instead of every schema going through each phase together. Cannot be used with -stream, -shard-group or writing -cache-file")
+	concurrencyString := flag.String("concurrency", "1", "Number of tables to scan concurrently, optionally per schema, e.g. '4,tenant_a=1,tenant_b=8' (unlisted schemas share the bare value)")
+	idTypeString := flag.String("id-type", "_tidb_rowid", "Kind of auto-generated ID to target (_tidb_rowid | auto_random | auto_increment)")
+	idColumn := flag.String("id-column", "", "Integer column to find the max ID from instead of _tidb_rowid or the AUTO_INCREMENT column. Tables without this column are skipped")
+	infoSchemaCurrent := flag.Bool("infoschema-current", false, "Read the current IDs to compare against from information_schema.tables in one query, instead of SHOW TABLE NEXT_ROW_ID per table (not for auto_random). Tables without an AUTO_INCREMENT column are still compared one by one")
+	maxOpenConns := flag.Int("max-open-conns", 0, "Maximum number of open connections to the database (default: the larger of -concurrency plus -schema-concurrency and -ddl-concurrency)")
+	maxIdleConns := flag.Int("max-idle-conns", 0, "Maximum number of idle connections kept in the pool (default: -max-open-conns)")
+	connMaxLifetime := flag.Duration("conn-max-lifetime", 0, "Maximum time a connection may be reused (default: forever)")
+	unionSize := flag.Int("union-size", 1, "Find the max row IDs of up to this many tables of a schema in a single UNION ALL query, falling back to one query per table on error")
+	asOf := flag.String("as-of", "", "Find the max row IDs from the snapshot at this time ('YYYY-MM-DD hh:mm:ss') with a stale read. Rows inserted since are not counted, so use a generous -buffer in rebase mode")
+	strictRowID := flag.Bool("strict-rowid", false, "Count the tables without the ID column (e.g. _tidb_rowid) as errors instead of silently skipping them")
+	explain := flag.Bool("explain", false, "Log the query plan of each max row ID scan, to tell full table scans from reverse scans")
+	fastMax := flag.Bool("fast-max", false, "Find the max ID of unsharded tables by a reverse index scan instead of a full scan, assuming no IDs were allocated beyond the max")
+	rateString := flag.String("rate", "0", "Maximum number of max row ID queries and ALTER statements per second, optionally per schema, e.g. '10,tenant_a=2' (unlisted schemas share the bare value; 0 means unlimited)")
+	maxRetries := flag.Int("max-retries", 3, "Maximum number of retries of a statement failing with a transient error")
+	retryDelay := flag.Duration("retry-delay", time.Second, "Delay before the first retry, doubled after every attempt")
+	buffer := flag.Int64("buffer", 1, "Amount added to the max row ID to compute the AUTO_INCREMENT value, giving headroom for in-flight inserts")
+	maxTables := flag.Int("max-tables", 0, "Stop collecting tables once this many are ready to be processed (default: no limit)")
+	since := flag.Duration("since", 0, "Only process tables modified within this duration, according to information_schema.tables.update_time (default: all tables)")
+	minAutoInc := flag.Int64("min-autoinc", 0, "Skip tables whose computed AUTO_INCREMENT value is below this threshold")
+	ddlConcurrency := flag.Int("ddl-concurrency", 1, "Number of tables to rebase or compare concurrently during execution, independent from -concurrency")
+	batchSize := flag.Int("batch-size", 1, "In rebase mode, number of ALTER statements sent in a single round trip")
+	failFast := flag.Bool("fail-fast", false, "Stop with a non-zero exit status at the first table failing to be rebased or compared")
+	tolerance := flag.Int64("tolerance", 0, "In compare mode, still report tables as ok if NEXT_GLOBAL_ROW_ID is at most this much below the expected value")
+	floor := flag.Int64("floor", 0, "In compare mode, compare every table against this fixed value instead of its scanned max row ID (default: disabled)")
+	gapThreshold := flag.Int64("gap-threshold", 0, "In compare mode, report tables as HIGH if NEXT_GLOBAL_ROW_ID exceeds the expected value by more than this (default: disabled)")
+	strict := flag.Bool("strict", false, "In compare mode, exit with status 4 if any table is reported as ERROR. Also fail if any schema does not exist")
+	noProgress := flag.Bool("no-progress", false, "Do not log the [N/M] progress of each table during execution")
+	pprofAddr := flag.String("pprof-addr", "", "Address to serve the runtime profiles on at /debug/pprof/, e.g. 'localhost:6060' (default: disabled)")
+	metricsAddr := flag.String("metrics-addr", "", "Address to serve Prometheus metrics on at /metrics, e.g. ':9090' (default: disabled)")
+	scanTimeout := flag.Duration("scan-timeout", 0, "Skip a table if finding its max row ID takes longer than this duration, also bounding each -union-size query (default: no timeout)")
+	timeout := flag.Duration("timeout", 0, "Abort the whole run after this duration, exiting with status 5 (default: no timeout)")
+	verify := flag.Bool("verify", false, "In rebase mode, read back NEXT_ROW_ID after each ALTER to confirm it took effect")
+	checkpointFile := flag.String("checkpoint", "", "In rebase mode, file recording the rebased tables, which are skipped when the run is resumed")
+	resetCheckpoint := flag.Bool("reset-checkpoint", false, "Clear the -checkpoint file before starting")
+	auditLogFile := flag.String("audit-log", "", "File to append a JSON record of every executed ALTER statement to")
+	scriptOut := flag.String("script-out", "", "In rebase mode, write the ALTER statements to this SQL file instead of executing them")
+	var yes bool
+	flag.BoolVar(&yes, "yes", false, "In rebase mode, do not ask for confirmation before altering the tables")
+	flag.BoolVar(&yes, "y", false, "Shorthand of -yes")
+	stream := flag.Bool("stream", false, "Execute the tables as they are collected instead of after collecting all of them, bounding the memory use on clusters with many tables. Cannot be used with -batch-size, -cache-file, -infoschema-current or the plan mode")
+	dryRun := flag.Bool("dry-run", false, "In rebase mode, only print the ALTER statements without executing them")
+
+	flag.Usage = usage
 	flag.Parse()
+	runStart := time.Now()
+
+	if *configFile != "" {
+		if err := applyConfigFile(*configFile); err != nil {
+			fatal("Error loading -config", "error", err)
+		}
+	}
+
+	if *defaultsFile != "" {
+		if err := applyDefaultsFile(*defaultsFile); err != nil {
+			fatal("Error loading -defaults-file", "error", err)
+		}
+	}
+
+	if *quiet {
+		*logLevel = "warn"
+	}
+	if err := setupLogger(*logLevel, *logFormat); err != nil {
+		flag.Usage()
+		fatal("Invalid logging options", "error", err)
+	}
+
+	// The baseline is read before creating the output, which may be the same
+	// file when monitoring the drift between consecutive runs.
+	var base baseline
+	if *baselineFile != "" {
+		var err error
+		if base, err = readBaseline(*baselineFile); err != nil {
+			fatal("Error loading -baseline", "error", err)
+		}
+		slog.Info("Loaded baseline", "tables", len(base))
+	}
+
+	output := os.Stdout
+	if *outputFile != "" {
+		f, err := os.Create(*outputFile)
+		if err != nil {
+			fatal("Error creating output file", "error", err)
+		}
+		output = f
+	} else if *tee {
+		flag.Usage()
+		fatal("The -tee flag requires -output.")
+	}
+	var sink io.Writer = output
+	if *tee {
+		sink = io.MultiWriter(os.Stdout, output)
+	}
+
+	out, err := newResultWriter(*format, sink, base != nil)
+	if err != nil {
+		flag.Usage()
+		fatal("Invalid format specified", "error", err)
+	}
 
 	var mode int
+	applyPlan := false
 	switch *modeString {
 	case "compare":
 		mode = modeCompare
-		fmt.Println("Schema,Table,Expected,Current,Status")
+		if err := out.WriteHeader(); err != nil {
+			fatal("Error writing output header", "error", err)
+		}
 	case "rebase":
 		mode = modeRebase
+	case "preflight":
+		mode = modePreflight
+	case "check":
+		mode = modeCheck
+	case "audit-rowid":
+		mode = modeAuditRowID
+	case "plan":
+		mode = modePlan
+	case "apply":
+		// Applying a plan is rebasing the tables in it without scanning.
+		mode = modeRebase
+		applyPlan = true
+	case "rebase-if-needed":
+		mode = modeRebaseIfNeeded
+		if err := out.WriteHeader(); err != nil {
+			fatal("Error writing output header", "error", err)
+		}
 	default:
 		flag.Usage()
-		log.Fatalf("! Invalid mode specified. Use 'compare' or 'rebase'.\n")
+		fatal("Invalid mode specified. Use 'compare', 'rebase', 'rebase-if-needed', 'preflight', 'check', 'audit-rowid', 'plan' or 'apply'.", "mode", *modeString)
+	}
+	if (mode == modePlan || applyPlan) && *planFile == "" {
+		fatal("The plan and apply modes require -plan.")
 	}
 
-	schemas := strings.Split(*schemaList, ",")
-	log.Printf("# Target Schemas: %v\n", schemas)
+	var script *os.File
+	if *scriptOut != "" {
+		if mode == modeCompare {
+			fatal("-script-out is not supported in compare mode.")
+		}
+		f, err := os.Create(*scriptOut)
+		if err != nil {
+			fatal("Error creating script file", "error", err)
+		}
+		script = f
+	}
 
-	// 2. Connect to the database
-	// DSN (Data Source Name) format: username:password@protocol(address)/
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/", *user, *password, *host, *port)
-	db, err := sql.Open("mysql", dsn)
-	if err != nil {
-		log.Fatalf("! Error opening database connection: %v\n", err)
+	var audit *auditLog
+	if *auditLogFile != "" {
+		audit, err = openAuditLog(*auditLogFile)
+		if err != nil {
+			fatal("Error opening audit log", "error", err)
+		}
+		defer audit.close()
+	}
+
+	var done *checkpoint
+	if *checkpointFile != "" {
+		if mode == modeCompare {
+			fatal("-checkpoint is not supported in compare mode.")
+		}
+		done, err = openCheckpoint(*checkpointFile, *resetCheckpoint)
+		if err != nil {
+			fatal("Error opening checkpoint", "error", err)
+		}
+		defer done.close()
+		slog.Info("Loaded checkpoint", "completed", len(done.done))
+	}
+
+	if *passwordFile != "" {
+		content, err := os.ReadFile(*passwordFile)
+		if err != nil {
+			fatal("Error reading -password-file", "error", err)
+		}
+		if *password != "" {
+			slog.Warn("Both -password and -password-file are set, using -password.")
+		} else {
+			*password = strings.TrimRight(string(content), "\r\n")
+		}
+	}
+
+	if envPassword := os.Getenv(*passwordEnv); *passwordEnv != "" && envPassword != "" {
+		if *password != "" {
+			slog.Warn("Both -password (or -password-file) and the password environment variable are set, using the former.", "env", *passwordEnv)
+		} else {
+			*password = envPassword
+		}
+	}
+
+	idType := strings.ToUpper(*idTypeString)
+	if _, ok := autoid.ShardingInfoPrefixes[idType]; !ok {
+		flag.Usage()
+		fatal("Invalid ID type specified. Use '_tidb_rowid', 'auto_random' or 'auto_increment'.", "id_type", *idTypeString)
+	}
+	if mode == modeAuditRowID && (idType != autoid.IDTypeRowID || *idColumn != "") {
+		fatal("The audit-rowid mode only works with the default -id-type and without -id-column.")
 	}
-	defer db.Close()
 
-	log.Println("# Database connection successful.")
+	if *idColumn != "" && idType == autoid.IDTypeAutoRandom {
+		fatal("-id-column cannot be used with auto_random, which is always on the primary key.")
+	}
+
+	if *infoSchemaCurrent && idType == autoid.IDTypeAutoRandom {
+		fatal("-infoschema-current does not support auto_random, whose base is not in information_schema.tables.")
+	}
 
-	// 2.5. Obtain the shard_row_id_bits.
-	shardRowIDBits, err := collectShardRowIDBits(db, schemas)
+	if *maxRetries < 0 {
+		fatal("Invalid max-retries, must not be negative.", "max_retries", *maxRetries)
+	}
+	retry := retrier{maxRetries: *maxRetries, delay: *retryDelay}
+
+	shardGroups, err := parseShardGroups(*shardGroupList)
 	if err != nil {
-		log.Fatalf("! Error collecting shard_row_id_bits: %v\n", err)
+		flag.Usage()
+		fatal("Invalid shard-group", "error", err)
+	}
+	if *shardGroupRebase && len(shardGroups) == 0 {
+		fatal("-shard-group-rebase requires -shard-group.")
+	}
+	// The combined value must cover every member of a group, or the shards
+	// left out could have higher IDs than the value given to the others.
+	if *shardGroupRebase && (*checkpointFile != "" || *since > 0 || *tableRegex != "" || *excludeTables != "" || *maxTables > 0) {
+		fatal("-shard-group-rebase cannot be used together with -checkpoint, -since, -table-regex, -exclude-tables or -max-tables, which may leave out some shards from the combined value.")
+	}
+	if len(shardGroups) > 0 && *stream {
+		fatal("-shard-group cannot be used together with -stream, as the groups are only complete after the collection.")
 	}
 
-	// 3. Iterate through schemas and tables to find max row IDs
-	var tableInfos []tableInfo
-	for _, schema := range schemas {
-		log.Printf("# Processing schema: %s\n", schema)
+	excludePatterns, err := parseTablePatterns(*excludeTables)
+	if err != nil {
+		fatal("Invalid -exclude-tables", "error", err)
+	}
 
-		tables, err := getTablesInSchema(db, schema)
+	var tablePattern *regexp.Regexp
+	if *tableRegex != "" {
+		tablePattern, err = regexp.Compile(*tableRegex)
 		if err != nil {
-			log.Printf("! Error getting tables for schema %s: %v. Skipping schema.\n", schema, err)
-			continue
+			fatal("Invalid -table-regex", "error", err)
 		}
+	}
 
-		// 4. For each table, get max _tidb_rowid
-		for _, table := range tables {
-			tableName := tableName{Schema: schema, Table: table}
-			shardRowIDBit, _ := shardRowIDBits[tableName]
-			maxID, err := getMaxRowID(db, schema, table, shardRowIDBit)
-			if maxID == 0 {
-				if err != nil {
-					log.Printf("!    Skipping table %s.%s: %v.\n", schema, table, err)
-				}
-				continue
-			}
+	if *batchSize < 1 {
+		fatal("Invalid batch-size, must be at least 1.", "batch_size", *batchSize)
+	}
 
-			// Store the valid result
-			tableInfos = append(tableInfos, tableInfo{tableName: tableName, AutoInc: maxID + 1})
+	if *buffer < 1 || *buffer > math.MaxInt64-overflowThreshold {
+		fatal("Invalid buffer, must be positive and not close to overflowing.", "buffer", *buffer)
+	}
+
+	rateLimit, schemaRates, err := parseSchemaValues(*rateString, 0, func(s string) (float64, error) {
+		return strconv.ParseFloat(s, 64)
+	})
+	if err != nil {
+		fatal("Invalid rate", "error", err)
+	}
+	for _, r := range append(slices.Collect(maps.Values(schemaRates)), rateLimit) {
+		if r < 0 {
+			fatal("Invalid rate, must not be negative.", "rate", *rateString)
 		}
 	}
 
-	log.Println("# Finished collecting max row IDs.")
+	if *schemaConcurrency < 1 {
+		fatal("Invalid schema-concurrency, must be at least 1.", "schema_concurrency", *schemaConcurrency)
+	}
+	// Each schema is executed once collected, before the shard groups or the
+	// cache could cover every schema.
+	if *schemaConcurrency > 1 && (*stream || len(shardGroups) > 0 || (*cacheFile != "" && !*useCache)) {
+		fatal("The -schema-concurrency flag cannot be used together with -stream, -shard-group or writing -cache-file.")
+	}
 
-	log.Println("# Starting execution...")
-	for _, t := range tableInfos {
-		switch mode {
-		case modeRebase:
-			err = rebaseAutoIncrement(db, &t)
-		case modeCompare:
-			err = compareAutoIncrement(db, &t)
+	if *asOf != "" {
+		if _, err := time.Parse(time.DateTime, *asOf); err != nil {
+			fatal("Invalid as-of, must be in the 'YYYY-MM-DD hh:mm:ss' format.", "as_of", *asOf)
 		}
-		if err != nil {
-			log.Printf("!    Error executing for %s.%s: %v\n", t.Schema, t.Table, err)
+	}
+
+	if *stream {
+		if mode != modeCompare && mode != modeRebase && mode != modeRebaseIfNeeded {
+			fatal("The -stream flag only works in the compare, rebase, rebase-if-needed and apply modes.")
+		}
+		if *batchSize > 1 || *cacheFile != "" || *infoSchemaCurrent {
+			fatal("The -stream flag cannot be used together with -batch-size, -cache-file or -infoschema-current.")
 		}
 	}
 
-	log.Println("# Execution finished.")
-}
+	if *floor < 0 {
+		fatal("Invalid floor, must not be negative.", "floor", *floor)
+	}
+	if *floor > 0 && mode != modeCompare {
+		fatal("The -floor flag only works in compare mode.")
+	}
 
-// getTablesInSchema retrieves a list of table names within a given schema.
-func getTablesInSchema(db *sql.DB, schemaName string) ([]string, error) {
-	query := fmt.Sprintf("SHOW TABLES FROM `%s`", schemaName)
-	rows, err := db.Query(query)
-	if err != nil {
-		return nil, fmt.Errorf("querying tables for schema '%s': %w", schemaName, err)
+	if *gapThreshold < 0 {
+		fatal("Invalid gap-threshold, must not be negative.", "gap_threshold", *gapThreshold)
 	}
-	defer rows.Close()
 
-	var tables []string
-	for rows.Next() {
-		var tableName string
-		if err := rows.Scan(&tableName); err != nil {
-			return nil, fmt.Errorf("scanning table name for schema '%s': %w", schemaName, err)
-		}
-		tables = append(tables, tableName)
+	if *tolerance < 0 {
+		fatal("Invalid tolerance, must not be negative.", "tolerance", *tolerance)
 	}
 
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("iterating table rows for schema '%s': %w", schemaName, err)
+	if *maxTables < 0 {
+		fatal("Invalid max-tables, must not be negative.", "max_tables", *maxTables)
 	}
 
-	return tables, nil
-}
+	if *ddlConcurrency < 1 {
+		fatal("Invalid ddl-concurrency, must be at least 1.", "ddl_concurrency", *ddlConcurrency)
+	}
 
-// getMaxRowID queries the maximum _tidb_rowid for a specific table.
-func getMaxRowID(db *sql.DB, schemaName, tableName string, shardRowIDBit uint64) (int64, error) {
-	mask := (1 << (63 - shardRowIDBit)) - 1
-	query := fmt.Sprintf("SELECT coalesce(max(_tidb_rowid & %d), 0) FROM `%s`.`%s`", mask, schemaName, tableName)
-	var maxID int64
-	err := db.QueryRow(query).Scan(&maxID)
+	concurrency, schemaConcurrencies, err := parseSchemaValues(*concurrencyString, 1, strconv.Atoi)
+	if err != nil {
+		fatal("Invalid concurrency", "error", err)
+	}
+	// The scanning workers and the connection pool are sized for the slots of
+	// every listed schema on top of those shared by the unlisted schemas.
+	totalConcurrency := 0
+	for _, n := range append(slices.Collect(maps.Values(schemaConcurrencies)), concurrency) {
+		if n < 1 {
+			fatal("Invalid concurrency, must be at least 1.", "concurrency", *concurrencyString)
+		}
+		totalConcurrency += n
+	}
 
-	if unknownColumnError.Is(err) {
-		return 0, nil // Ignore the unknown column error
+	if *maxOpenConns < 0 || *maxIdleConns < 0 {
+		fatal("Invalid max-open-conns or max-idle-conns, must not be negative.", "max_open_conns", *maxOpenConns, "max_idle_conns", *maxIdleConns)
+	}
+	// Otherwise the schemas being listed could hold every connection while
+	// waiting for their tables to be scanned.
+	if *maxOpenConns != 0 && *maxOpenConns <= *schemaConcurrency {
+		fatal("Invalid max-open-conns, must be greater than -schema-concurrency.", "max_open_conns", *maxOpenConns, "schema_concurrency", *schemaConcurrency)
 	}
-	return maxID, err
-}
 
-func rebaseAutoIncrement(db *sql.DB, t *tableInfo) error {
-	query := fmt.Sprintf("ALTER TABLE `%s`.`%s` AUTO_INCREMENT = %d", t.Schema, t.Table, t.AutoInc)
-	log.Printf(">>> %s;", query)
-	if _, err := db.Exec(query); err != nil {
-		return fmt.Errorf("rebasing AUTO_INCREMENT for %s.%s: %w", t.Schema, t.Table, err)
+	var schemas []string
+	var explicitTables map[string][]string
+	var overrides map[autoid.TableName]int64
+	if *overridesFile != "" {
+		if *allSchemas || *schemaRegex != "" || *tableList != "" || *schemaList != "" || *schemasFile != "" {
+			fatal("-overrides-file cannot be used together with -schemas, -schemas-file, -schema-regex, -all-schemas or -tables.")
+		}
+		schemas, explicitTables, overrides, err = readOverridesFile(*overridesFile)
+		if err != nil {
+			fatal("Error reading -overrides-file", "error", err)
+		}
 	}
-	return nil
-}
 
-func compareAutoIncrement(db *sql.DB, t *tableInfo) error {
-	query := fmt.Sprintf("SHOW TABLE `%s`.`%s` NEXT_ROW_ID", t.Schema, t.Table)
-	// perform the query and iterate the resultset, compare if the column `ID_TYPE` has value "_TIDB_ROWID". if yes, read the value in the `NEXT_GLOBAL_ROW_ID` column.
-	rows, err := db.Query(query)
-	if err != nil {
-		return fmt.Errorf("comparing NEXT_ROW_ID for %s.%s: %w", t.Schema, t.Table, err)
+	// A cached scan is used like an overrides file, skipping the scan of the
+	// tables in it.
+	if *useCache {
+		if *cacheFile == "" {
+			fatal("-use-cache requires -cache-file.")
+		}
+		if *overridesFile != "" || *allSchemas || *schemaRegex != "" || *tableList != "" || *schemaList != "" || *schemasFile != "" {
+			fatal("-use-cache cannot be used together with -overrides-file, -schemas, -schemas-file, -schema-regex, -all-schemas or -tables.")
+		}
+		cache, err := readScanCache(*cacheFile)
+		if err != nil {
+			fatal("Error reading -cache-file", "error", err)
+		}
+		age := time.Since(cache.ScannedAt)
+		if age > cacheStaleAfter {
+			slog.Warn("The cache is stale, the max row IDs may have grown since.", "scanned_at", cache.ScannedAt, "age", age)
+		} else {
+			slog.Info("Using cached scan", "scanned_at", cache.ScannedAt, "tables", len(cache.Tables))
+		}
+		explicitTables = make(map[string][]string)
+		overrides = make(map[autoid.TableName]int64, len(cache.Tables))
+		for _, t := range cache.Tables {
+			if t.IDType != idType {
+				fatal("The cache was collected for a different -id-type.", "cached", t.IDType, "id_type", idType)
+			}
+			if _, ok := explicitTables[t.Schema]; !ok {
+				schemas = append(schemas, t.Schema)
+			}
+			explicitTables[t.Schema] = append(explicitTables[t.Schema], t.Table)
+			overrides[t.TableName] = t.AutoInc
+		}
 	}
-	defer rows.Close()
 
-	cols, err := rows.Columns()
-	if err != nil {
-		return fmt.Errorf("getting columns for next row id query '%s.%s': %w", t.Schema, t.Table, err)
+	// A plan is applied like an overrides file, skipping the scan of the tables
+	// in it.
+	if applyPlan {
+		if *useCache || *overridesFile != "" || *allSchemas || *schemaRegex != "" || *tableList != "" || *schemaList != "" || *schemasFile != "" {
+			fatal("The apply mode cannot be used together with -use-cache, -overrides-file, -schemas, -schemas-file, -schema-regex, -all-schemas or -tables.")
+		}
+		plan, err := readPlan(*planFile)
+		if err != nil {
+			fatal("Error reading -plan", "error", err)
+		}
+		slog.Info("Applying plan", "created_at", plan.CreatedAt, "tables", len(plan.Rebases))
+		explicitTables = make(map[string][]string)
+		overrides = make(map[autoid.TableName]int64, len(plan.Rebases))
+		for i := range plan.Rebases {
+			t := plan.Rebases[i].tableInfo()
+			if t.IDType != idType {
+				fatal("The plan was made for a different -id-type.", "planned", t.IDType, "id_type", idType)
+			}
+			if _, ok := explicitTables[t.Schema]; !ok {
+				schemas = append(schemas, t.Schema)
+			}
+			explicitTables[t.Schema] = append(explicitTables[t.Schema], t.Table)
+			overrides[t.TableName] = t.AutoInc
+		}
 	}
 
-	// Find indices of required columns
-	idTypeIndex := -1
-	nextIDIndex := -1
-	for i, colName := range cols {
-		// Case-insensitive comparison just to be safe, although SHOW output is usually consistent
-		switch strings.ToUpper(colName) {
-		case "ID_TYPE":
-			idTypeIndex = i
-		case "NEXT_GLOBAL_ROW_ID":
-			nextIDIndex = i
+	var schemaPattern *regexp.Regexp
+	if *schemaRegex != "" {
+		if *allSchemas || *tableList != "" {
+			fatal("-schema-regex cannot be used together with -all-schemas or -tables.")
+		}
+		schemaPattern, err = regexp.Compile(*schemaRegex)
+		if err != nil {
+			fatal("Invalid -schema-regex", "error", err)
 		}
 	}
-	if idTypeIndex == -1 || nextIDIndex == -1 {
-		return fmt.Errorf("required columns 'ID_TYPE' or 'NEXT_GLOBAL_ROW_ID' not found in output of SHOW TABLE NEXT_ROW_ID for '%s.%s'", t.Schema, t.Table)
+	if *allSchemas {
+		if *schemaList != "" || *schemasFile != "" || *tableList != "" {
+			fatal("-all-schemas cannot be used together with -schemas, -schemas-file or -tables.")
+		}
+	} else if overrides != nil {
+		// The schemas and tables were already read from the overrides file.
+	} else if *tableList != "" {
+		schemas, explicitTables, err = parseTableList(*tableList)
+		if err != nil {
+			fatal("Invalid -tables", "error", err)
+		}
+		if *schemaList != "" || *schemasFile != "" {
+			slog.Warn("Both -tables and -schemas are set, ignoring -schemas and -schemas-file.")
+		}
+	} else {
+		schemas = parseSchemaList(*schemaList)
+		if *schemasFile != "" {
+			fileSchemas, err := readSchemasFile(*schemasFile)
+			if err != nil {
+				fatal("Error reading -schemas-file", "error", err)
+			}
+			schemas = uniqueStrings(append(schemas, fileSchemas...))
+		}
+	}
+	if !*allSchemas && schemaPattern == nil && mode != modeCheck {
+		if len(schemas) == 0 && *database != "" {
+			slog.Info("No schema given, using the default database.", "database", *database)
+			schemas = []string{*database}
+		}
+		if len(schemas) == 0 {
+			flag.Usage()
+			fatal("At least one schema is required. Use -schemas, -schemas-file, -schema-regex, -all-schemas, -tables, -overrides-file or -database.")
+		}
+		slog.Info("Target schemas", "count", len(schemas), "schemas", schemas)
 	}
 
-	// Create slices for scanning row data
-	scanArgs := make([]interface{}, len(cols))
-	for i := range scanArgs {
-		switch i {
-		case idTypeIndex:
-			scanArgs[i] = new(string)
-		case nextIDIndex:
-			scanArgs[i] = new(int64)
-		default:
-			scanArgs[i] = new(sql.RawBytes)
+	if *metricsAddr != "" {
+		stopMetrics, err := startMetricsServer(*metricsAddr)
+		if err != nil {
+			fatal("Error starting metrics server", "error", err)
 		}
+		defer stopMetrics()
 	}
 
-	for rows.Next() {
-		if err := rows.Scan(scanArgs...); err != nil {
-			return fmt.Errorf("scanning row for schema '%s' table '%s': %w", t.Schema, t.Table, err)
+	if *pprofAddr != "" {
+		stopPprof, err := startPprofServer(*pprofAddr)
+		if err != nil {
+			fatal("Error starting pprof server", "error", err)
 		}
+		defer stopPprof()
+	}
 
-		if *(scanArgs[idTypeIndex].(*string)) != "_TIDB_ROWID" {
-			continue
+	// 2. Connect to the database
+	// DSN (Data Source Name) format: username:password@protocol(address)/dbname
+	if *protocol == "" || strings.ContainsAny(*protocol, "()/@") {
+		fatal("Invalid protocol.", "protocol", *protocol)
+	}
+	addresses := hostAddresses(*host, *port, *protocol)
+	if *socket != "" {
+		if err := checkSocket(*socket); err != nil {
+			fatal("Invalid -socket", "error", err)
 		}
-		nextGlobalRowID := *(scanArgs[nextIDIndex].(*int64))
-		var status string
-		if nextGlobalRowID >= t.AutoInc {
-			status = "ok"
-		} else {
-			status = "ERROR"
+		addresses = []string{fmt.Sprintf("unix(%s)", *socket)}
+	}
+	dsnParams := url.Values{}
+	if *tlsCA != "" || *tlsCert != "" || *tlsKey != "" || *tlsSkipVerify {
+		tlsName, err := registerTLSConfig(*tlsCA, *tlsCert, *tlsKey, *tlsSkipVerify)
+		if err != nil {
+			fatal("Error configuring TLS", "error", err)
 		}
-		fmt.Printf("%s,%s,%d,%d,%s\n", t.Schema, t.Table, t.AutoInc, nextGlobalRowID, status)
+		dsnParams.Set("tls", tlsName)
+	}
+	if *batchSize > 1 {
+		dsnParams.Set("multiStatements", "true")
+	}
+	if *connectTimeout > 0 {
+		dsnParams.Set("timeout", connectTimeout.String())
 	}
+	if *dsnParamString != "" {
+		extraParams, err := url.ParseQuery(*dsnParamString)
+		if err != nil {
+			fatal("Invalid -dsn-params", "error", err)
+		}
+		for key, values := range extraParams {
+			dsnParams[key] = values
+		}
+	}
+	db, address, err := openFirstReachable(addresses, func(address string) string {
+		dsn := fmt.Sprintf("%s:%s@%s/%s", *user, *password, address, url.PathEscape(*database))
+		if len(dsnParams) > 0 {
+			dsn += "?" + dsnParams.Encode()
+		}
+		return dsn
+	}, parseInitSQL(*initSQL), *connectTimeout)
+	if err != nil {
+		fatalWithStatus(exitConnection, "Error connecting to the database. Check that the host and port are correct and reachable.", "error", err)
+	}
+	defer db.Close()
+	if *maxOpenConns == 0 {
+		// Each schema being listed holds a connection while its tables are
+		// scanned.
+		*maxOpenConns = max(totalConcurrency+*schemaConcurrency, *ddlConcurrency)
+	}
+	if *maxIdleConns == 0 {
+		*maxIdleConns = *maxOpenConns
+	}
+	db.SetMaxOpenConns(*maxOpenConns)
+	db.SetMaxIdleConns(*maxIdleConns)
+	db.SetConnMaxLifetime(*connMaxLifetime)
 
-	if err = rows.Err(); err != nil {
-		return fmt.Errorf("iterating next row id results for '%s.%s': %w", t.Schema, t.Table, err)
+	if script != nil {
+		if err := writeScriptHeader(script, address, time.Now()); err != nil {
+			fatal("Error writing script header", "error", err)
+		}
 	}
 
-	return nil
-}
+	slog.Info("Database connection successful.", "address", address)
 
-func collectShardRowIDBits(db *sql.DB, schemas []string) (map[tableName]uint64, error) {
-	var query strings.Builder
-	query.WriteString("select table_schema, table_name, cast(substr(tidb_row_id_sharding_info, 12) as unsigned) bits from information_schema.tables where table_schema in (")
-	for i, schema := range schemas {
-		if i != 0 {
-			query.WriteByte(',')
+	client := &autoid.Client{DB: db, FastMax: *fastMax, Tolerance: *tolerance, GapThreshold: *gapThreshold, AsOf: *asOf, StrictRowID: *strictRowID, Explain: *explain}
+	if *verbose {
+		client.DB = loggingQuerier{Querier: db}
+	}
+	if *verboseErrors {
+		client.DB = errorLoggingQuerier{Querier: client.DB}
+	}
+	if rateLimit > 0 {
+		client.Limiter = rate.NewLimiter(rate.Limit(rateLimit), 1)
+	}
+	if len(schemaRates) > 0 {
+		client.SchemaLimiters = make(map[string]*rate.Limiter, len(schemaRates))
+		for schema, r := range schemaRates {
+			if r > 0 {
+				client.SchemaLimiters[schema] = rate.NewLimiter(rate.Limit(r), 1)
+			} else {
+				client.SchemaLimiters[schema] = nil
+			}
 		}
-		query.WriteByte('"')
-		query.WriteString(schema) // TODO: escape?
-		query.WriteByte('"')
 	}
-	query.WriteString(") and tidb_row_id_sharding_info like 'SHARD_BITS=%';")
 
-	rows, err := db.Query(query.String())
-	if err != nil {
-		return nil, fmt.Errorf("querying shard_row_id_bits: %w", err)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// Restore the default behaviour after the first signal, so a second one
+	// force-exits even if a DDL statement hangs.
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	if version, err := client.Version(ctx); err != nil {
+		slog.Warn("Cannot detect the server version", "error", err)
+	} else {
+		slog.Info("Detected server version", "version", version)
 	}
-	defer rows.Close()
 
-	shardRowIDBits := make(map[tableName]uint64)
-	for rows.Next() {
-		var name tableName
-		var bits uint64
-		if err := rows.Scan(&name.Schema, &name.Table, &bits); err != nil {
-			return nil, fmt.Errorf("scanning shard_row_id_bits row: %w", err)
+	if mode == modeCheck {
+		if !runCheck(ctx, client, sink, address) {
+			fatal("Check failed.")
 		}
-		shardRowIDBits[name] = bits
+		slog.Info("Check passed.")
+		return
 	}
 
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("iterating shard_row_id_bits rows: %w", err)
+	if (mode == modeRebase || mode == modeRebaseIfNeeded) && !*dryRun && script == nil {
+		readOnly, err := client.ReadOnly(ctx)
+		if err != nil {
+			fatal("Error checking if the server is writable", "error", err)
+		}
+		if readOnly {
+			fatal("The server is read-only, cannot rebase. Connect to a writable TiDB instance, or use -dry-run or -script-out.")
+		}
 	}
 
-	return shardRowIDBits, nil
+	r := &runner{
+		client:   client,
+		retry:    retry,
+		mode:     mode,
+		modeName: *modeString,
+		user:     *user,
+		idType:   idType,
+		idColumn: *idColumn,
+		runStart: runStart,
+
+		out:       out,
+		sink:      sink,
+		output:    output,
+		format:    *format,
+		base:      base,
+		script:    script,
+		scriptOut: *scriptOut,
+		audit:     audit,
+		done:      done,
+
+		schemas:            schemas,
+		explicitTables:     explicitTables,
+		overrides:          overrides,
+		allSchemas:         *allSchemas,
+		schemaPattern:      schemaPattern,
+		allowSystemSchemas: *allowSystemSchemas,
+		strict:             *strict,
+		tablePattern:       tablePattern,
+		excludePatterns:    excludePatterns,
+		since:              *since,
+		maxTables:          *maxTables,
+		shardGroups:        shardGroups,
+		shardGroupRebase:   *shardGroupRebase,
+
+		floor:       *floor,
+		buffer:      *buffer,
+		minAutoInc:  *minAutoInc,
+		unionSize:   *unionSize,
+		scanTimeout: *scanTimeout,
+
+		concurrency:         concurrency,
+		schemaConcurrencies: schemaConcurrencies,
+		totalConcurrency:    totalConcurrency,
+		schemaConcurrency:   *schemaConcurrency,
+		ddlConcurrency:      *ddlConcurrency,
+		batchSize:           *batchSize,
+		stream:              *stream,
+
+		yes:               yes,
+		dryRun:            *dryRun,
+		verify:            *verify,
+		failFast:          *failFast,
+		noProgress:        *noProgress,
+		onlyErrors:        *onlyErrors,
+		cacheFile:         *cacheFile,
+		useCache:          *useCache,
+		infoSchemaCurrent: *infoSchemaCurrent,
+		planFile:          *planFile,
+	}
+	r.run(ctx)
+}
+
+// computeAutoInc returns the AUTO_INCREMENT value to rebase to given the max
+// row ID and the buffer added above it, refusing values which are negative or
+// close to overflowing.
+func computeAutoInc(maxID, buffer int64) (int64, error) {
+	if maxID < 0 {
+		return 0, fmt.Errorf("max row ID %d is negative", maxID)
+	}
+	if maxID > math.MaxInt64-overflowThreshold-buffer {
+		return 0, fmt.Errorf("max row ID %d plus buffer %d is within %d of overflowing", maxID, buffer, overflowThreshold)
+	}
+	return maxID + buffer, nil
+}
+
+// checkSocket checks that the path exists and is a Unix socket.
+func checkSocket(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("'%s' is not a socket", path)
+	}
+	return nil
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus metrics of the run, served on -metrics-addr.
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	tablesProcessedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "force_rebase_tables_processed_total",
+		Help: "Number of tables reaching the execution phase.",
+	}, []string{"mode"})
+	errorsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "force_rebase_errors_total",
+		Help: "Number of tables failed either in the scan or the execution.",
+	})
+	queryDurationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "force_rebase_query_duration_seconds",
+		Help:    "Latency of the queries on each table.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"query"})
+	progressGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "force_rebase_progress_ratio",
+		Help: "Fraction of the collected tables processed in the execution phase.",
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(tablesProcessedCounter, errorsCounter, queryDurationHistogram, progressGauge)
+}
+
+// observeQuery records the time elapsed since start in the query latency
+// histogram.
+func observeQuery(query string, start time.Time) {
+	queryDurationHistogram.WithLabelValues(query).Observe(time.Since(start).Seconds())
+}
+
+// startMetricsServer serves the metrics over HTTP on the address in the
+// background. Returns a function which shuts down the server.
+func startMetricsServer(addr string) (func(), error) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	return startHTTPServer(addr, "metrics", mux)
+}
+
+// startHTTPServer serves the handler over HTTP on the address in the
+// background, naming it in the logs. Returns a function which shuts down the
+// server.
+func startHTTPServer(addr, name string, handler http.Handler) (func(), error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Handler: handler}
+	go func() {
+		if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("HTTP server stopped", "server", name, "error", err)
+		}
+	}()
+	slog.Info("Serving "+name, "address", listener.Addr().String())
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Warn("Error shutting down HTTP server", "server", name, "error", err)
+		}
+	}, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"force-rebase-11167/autoid"
+)
+
+// resultWriter formats the compare results into an output stream.
+type resultWriter interface {
+	// WriteHeader writes anything needed before the first result.
+	WriteHeader() error
+	// WriteResult writes a single result.
+	WriteResult(r *autoid.CompareResult) error
+}
+
+// newResultWriter creates a resultWriter for the given format name. If drift is
+// true, the drift of each result is written as an extra column.
+func newResultWriter(format string, w io.Writer, drift bool) (resultWriter, error) {
+	switch format {
+	case "csv":
+		return csvResultWriter{w: w, drift: drift}, nil
+	case "json":
+		return jsonResultWriter{enc: json.NewEncoder(w)}, nil
+	case "markdown":
+		return markdownResultWriter{w: w, drift: drift}, nil
+	default:
+		return nil, fmt.Errorf("unknown output format '%s'", format)
+	}
+}
+
+// csvResultWriter writes the results as comma-separated values.
+type csvResultWriter struct {
+	w     io.Writer
+	drift bool
+}
+
+func (c csvResultWriter) WriteHeader() error {
+	header := "Schema,Table,Expected,Current,Status"
+	if c.drift {
+		header += ",Drift"
+	}
+	_, err := fmt.Fprintln(c.w, header)
+	return err
+}
+
+func (c csvResultWriter) WriteResult(r *autoid.CompareResult) error {
+	line := fmt.Sprintf("%s,%s,%d,%d,%s", r.Schema, r.Table, r.Expected, r.Current, r.Status)
+	if c.drift {
+		line += "," + r.Drift
+	}
+	_, err := fmt.Fprintln(c.w, line)
+	return err
+}
+
+// jsonResultWriter writes the results as newline-delimited JSON objects.
+type jsonResultWriter struct {
+	enc *json.Encoder
+}
+
+func (jsonResultWriter) WriteHeader() error {
+	return nil
+}
+
+func (j jsonResultWriter) WriteResult(r *autoid.CompareResult) error {
+	return j.enc.Encode(r)
+}
+
+// markdownResultWriter writes the results as a GitHub-flavored Markdown table.
+type markdownResultWriter struct {
+	w     io.Writer
+	drift bool
+}
+
+func (m markdownResultWriter) WriteHeader() error {
+	header := "| Schema | Table | Expected | Current | Status |\n|---|---|---:|---:|---|\n"
+	if m.drift {
+		header = "| Schema | Table | Expected | Current | Status | Drift |\n|---|---|---:|---:|---|---|\n"
+	}
+	_, err := fmt.Fprint(m.w, header)
+	return err
+}
+
+func (m markdownResultWriter) WriteResult(r *autoid.CompareResult) error {
+	line := fmt.Sprintf("| %s | %s | %d | %d | %s |", markdownEscape(r.Schema), markdownEscape(r.Table), r.Expected, r.Current, r.Status)
+	if m.drift {
+		line += " " + r.Drift + " |"
+	}
+	_, err := fmt.Fprintln(m.w, line)
+	return err
+}
+
+// markdownEscape escapes the characters which would break a table cell.
+func markdownEscape(s string) string {
+	return strings.ReplaceAll(s, "|", "\\|")
+}
+
+// writePreflight writes the number of tables to process in each schema, in
+// the given order, followed by the total.
+func writePreflight(w io.Writer, schemas []string, counts map[string]int) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "Schema\tTables")
+	total := 0
+	for _, schema := range schemas {
+		fmt.Fprintf(tw, "%s\t%d\n", schema, counts[schema])
+		total += counts[schema]
+	}
+	fmt.Fprintf(tw, "Total\t%d\n", total)
+	return tw.Flush()
+}
+
+// Categories of the tables without _tidb_rowid in the audit-rowid mode.
+const (
+	rowIDCategoryAutoRandom = "auto_random" // the AUTO_RANDOM primary key replaces the row ID
+	rowIDCategoryClustered  = "clustered"   // the clustered primary key replaces the row ID
+	rowIDCategoryOther      = "other"       // e.g. views
+)
+
+// rowIDAuditEntry is a table without _tidb_rowid found in audit-rowid mode.
+type rowIDAuditEntry struct {
+	autoid.TableName
+	Category string
+}
+
+// writeRowIDAudit writes the tables without _tidb_rowid sorted by name,
+// followed by the total.
+func writeRowIDAudit(w io.Writer, entries []rowIDAuditEntry) error {
+	slices.SortFunc(entries, func(a, b rowIDAuditEntry) int {
+		return strings.Compare(a.Schema+"\x00"+a.Table, b.Schema+"\x00"+b.Table)
+	})
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "Schema\tTable\tCategory")
+	for _, e := range entries {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", e.Schema, e.Table, e.Category)
+	}
+	fmt.Fprintf(tw, "Total\t%d\t\n", len(entries))
+	return tw.Flush()
+}
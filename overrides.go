@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"force-rebase-11167/autoid"
+)
+
+// readOverridesFile reads a CSV file of `schema,table,value` rows giving the
+// AUTO_INCREMENT value to rebase each table to. Returns the schemas in order of
+// appearance, the tables of each schema, and the value of each table. Lines
+// starting with `#` are ignored.
+func readOverridesFile(path string) ([]string, map[string][]string, map[autoid.TableName]int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("opening overrides file: %w", err)
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = 3
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("reading overrides file: %w", err)
+	}
+
+	var schemas []string
+	tables := make(map[string][]string)
+	values := make(map[autoid.TableName]int64, len(records))
+	for _, record := range records {
+		name := autoid.TableName{Schema: strings.TrimSpace(record[0]), Table: strings.TrimSpace(record[1])}
+		if name.Schema == "" || name.Table == "" {
+			return nil, nil, nil, fmt.Errorf("empty schema or table name in overrides file entry '%s'", strings.Join(record, ","))
+		}
+		value, err := strconv.ParseInt(strings.TrimSpace(record[2]), 10, 64)
+		if err != nil || value <= 0 {
+			return nil, nil, nil, fmt.Errorf("value of '%s.%s' in overrides file is not a positive integer: '%s'", name.Schema, name.Table, record[2])
+		}
+		if _, ok := values[name]; ok {
+			return nil, nil, nil, fmt.Errorf("duplicated entry '%s.%s' in overrides file", name.Schema, name.Table)
+		}
+		if _, ok := tables[name.Schema]; !ok {
+			schemas = append(schemas, name.Schema)
+		}
+		tables[name.Schema] = append(tables[name.Schema], name.Table)
+		values[name] = value
+	}
+	return schemas, tables, values, nil
+}
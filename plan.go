@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"force-rebase-11167/autoid"
+)
+
+// rebasePlan is the content of the -plan file, listing the rebases intended by
+// the plan mode for review before the apply mode executes them.
+type rebasePlan struct {
+	CreatedAt time.Time       `json:"created_at"`
+	Rebases   []plannedRebase `json:"rebases"`
+}
+
+// plannedRebase is a single intended rebase. The statement is informational,
+// and must agree with the other fields.
+type plannedRebase struct {
+	Schema    string `json:"schema"`
+	Table     string `json:"table"`
+	IDType    string `json:"id_type"`
+	AutoInc   int64  `json:"auto_inc"`
+	Statement string `json:"statement"`
+}
+
+// tableInfo returns the table to rebase.
+func (p *plannedRebase) tableInfo() autoid.TableInfo {
+	return autoid.TableInfo{
+		TableName: autoid.TableName{Schema: p.Schema, Table: p.Table},
+		AutoInc:   p.AutoInc,
+		IDType:    p.IDType,
+	}
+}
+
+// writePlan saves the tables to rebase to the plan file.
+func writePlan(path string, createdAt time.Time, tables []autoid.TableInfo) error {
+	plan := rebasePlan{CreatedAt: createdAt, Rebases: make([]plannedRebase, len(tables))}
+	for i := range tables {
+		t := &tables[i]
+		plan.Rebases[i] = plannedRebase{
+			Schema:    t.Schema,
+			Table:     t.Table,
+			IDType:    t.IDType,
+			AutoInc:   t.AutoInc,
+			Statement: autoid.RebaseStatement(t) + ";",
+		}
+	}
+	content, err := json.MarshalIndent(&plan, "", "\t")
+	if err != nil {
+		return fmt.Errorf("encoding plan: %w", err)
+	}
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		return fmt.Errorf("writing plan file: %w", err)
+	}
+	return nil
+}
+
+// readPlan loads a plan written by the plan mode, rejecting entries whose
+// statement was edited without the values or vice versa.
+func readPlan(path string) (*rebasePlan, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading plan file: %w", err)
+	}
+	var plan rebasePlan
+	if err := json.Unmarshal(content, &plan); err != nil {
+		return nil, fmt.Errorf("parsing plan file: %w", err)
+	}
+	seen := make(map[autoid.TableName]struct{}, len(plan.Rebases))
+	for i := range plan.Rebases {
+		t := plan.Rebases[i].tableInfo()
+		if t.Schema == "" || t.Table == "" || t.AutoInc <= 0 {
+			return nil, fmt.Errorf("invalid plan entry #%d, the schema, table and a positive auto_inc are required", i+1)
+		}
+		if statement := autoid.RebaseStatement(&t) + ";"; plan.Rebases[i].Statement != statement {
+			return nil, fmt.Errorf("statement of '%s.%s' in plan file does not match its values, expected '%s'", t.Schema, t.Table, statement)
+		}
+		if _, ok := seen[t.TableName]; ok {
+			return nil, fmt.Errorf("duplicated entry '%s.%s' in plan file", t.Schema, t.Table)
+		}
+		seen[t.TableName] = struct{}{}
+	}
+	return &plan, nil
+}
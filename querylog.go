@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"time"
+
+	"force-rebase-11167/autoid"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// loggingQuerier logs every query sent through the wrapped Querier together
+// with its elapsed time. Only the SQL text with its arguments is logged, which
+// never contains the connection credentials. For QueryContext, the elapsed
+// time is until the first response, not including reading the rows.
+type loggingQuerier struct {
+	autoid.Querier
+}
+
+func (l loggingQuerier) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	defer logQuery(query, args, time.Now())
+	return l.Querier.QueryContext(ctx, query, args...)
+}
+
+func (l loggingQuerier) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	defer logQuery(query, args, time.Now())
+	return l.Querier.QueryRowContext(ctx, query, args...)
+}
+
+func (l loggingQuerier) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	defer logQuery(query, args, time.Now())
+	return l.Querier.ExecContext(ctx, query, args...)
+}
+
+// logQuery logs the query with its arguments and the time elapsed since start.
+func logQuery(query string, args []any, start time.Time) {
+	slog.Info("Query", "sql", interpolateQuery(query, args), "elapsed", time.Since(start))
+}
+
+// interpolateQuery replaces the `?` placeholders of the query outside the
+// quoted strings and identifiers with the literals of the args, for logging.
+func interpolateQuery(query string, args []any) string {
+	if len(args) == 0 {
+		return query
+	}
+	var b strings.Builder
+	var quote rune // the quote the current position is inside, if not 0
+	for _, c := range query {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'', c == '"', c == '`':
+			quote = c
+		case c == '?' && len(args) > 0:
+			b.WriteString(sqlLiteral(args[0]))
+			args = args[1:]
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// sqlLiteral formats the query argument as a SQL literal.
+func sqlLiteral(arg any) string {
+	switch v := arg.(type) {
+	case nil:
+		return "NULL"
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, bool:
+		return fmt.Sprint(v)
+	case []byte:
+		return sqlLiteral(string(v))
+	case time.Time:
+		return sqlLiteral(v.Format(time.DateTime))
+	default:
+		s := strings.NewReplacer("\\", "\\\\", "'", "''").Replace(fmt.Sprint(v))
+		return "'" + s + "'"
+	}
+}
+
+// errorLoggingQuerier logs the full SQL text with its arguments and the raw
+// driver error of every failed query sent through the wrapped Querier, in a
+// form which can be pasted into a client to reproduce it, together with the
+// stack of the caller. The errors the callers expect and recover from are only
+// logged at debug level, without the stack.
+type errorLoggingQuerier struct {
+	autoid.Querier
+}
+
+func (e errorLoggingQuerier) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	rows, err := e.Querier.QueryContext(ctx, query, args...)
+	logQueryError(query, args, err)
+	return rows, err
+}
+
+func (e errorLoggingQuerier) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	row := e.Querier.QueryRowContext(ctx, query, args...)
+	logQueryError(query, args, row.Err())
+	return row
+}
+
+func (e errorLoggingQuerier) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	result, err := e.Querier.ExecContext(ctx, query, args...)
+	logQueryError(query, args, err)
+	return result, err
+}
+
+// expectedQueryErrors are the MySQL error codes the callers fall back from:
+// the missing ID column of MaxRowID, the missing table skipped by the scan,
+// the unsupported SHOW TABLE NEXT_ROW_ID of Compare, and the system variables
+// and functions missing from older servers.
+var expectedQueryErrors = []uint16{
+	1054, // ER_BAD_FIELD_ERROR
+	1064, // ER_PARSE_ERROR
+	1146, // ER_NO_SUCH_TABLE
+	1193, // ER_UNKNOWN_SYSTEM_VARIABLE
+	1235, // ER_NOT_SUPPORTED_YET
+	1305, // ER_SP_DOES_NOT_EXIST
+}
+
+// logQueryError logs the failed query if err is not nil.
+func logQueryError(query string, args []any, err error) {
+	if err == nil {
+		return
+	}
+	sqlText := interpolateQuery(query, args) + ";"
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && slices.Contains(expectedQueryErrors, mysqlErr.Number) {
+		slog.Debug("Query failed", "sql", sqlText, "driver_error", err.Error(), "error_type", fmt.Sprintf("%T", err))
+		return
+	}
+	slog.Error("Query failed", "sql", sqlText, "driver_error", err.Error(), "error_type", fmt.Sprintf("%T", err), "stack", string(debug.Stack()))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// MySQL error codes which are worth retrying.
+var (
+	lockWaitTimeoutError = &mysql.MySQLError{Number: 1205}
+	deadlockError        = &mysql.MySQLError{Number: 1213}
+)
+
+// schemaOutdatedError is the TiDB error "Information schema is out of date",
+// returned by DDL racing with another schema change.
+var schemaOutdatedError = &mysql.MySQLError{Number: 8027}
+
+// Retries of a DDL failing with schemaOutdatedError. The error clears once the
+// schema version settles, so the delay is fixed rather than backing off.
+const (
+	schemaOutdatedRetries = 5
+	schemaOutdatedDelay   = 3 * time.Second
+)
+
+// retrier retries operations failing with transient errors, with exponential
+// backoff between the attempts.
+type retrier struct {
+	maxRetries int
+	delay      time.Duration
+}
+
+// do runs op until it succeeds, fails with a non-transient error, or the
+// retries are exhausted. target names what op is working on in the logs.
+func (r retrier) do(ctx context.Context, target string, op func() error) error {
+	delay := r.delay
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt > r.maxRetries || !isTransientError(err) {
+			return err
+		}
+		slog.Debug("Retrying", "target", target, "attempt", attempt, "max_retries", r.maxRetries, "delay", delay, "error", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// isTransientError checks if the error is likely caused by a temporary network
+// or locking issue, such that retrying the same statement may succeed.
+func isTransientError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if lockWaitTimeoutError.Is(err) || deadlockError.Is(err) {
+		return true
+	}
+	if errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, mysql.ErrInvalidConn) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// retrySchemaOutdated runs the DDL op until it succeeds, fails with an error
+// other than schemaOutdatedError, or the retries are exhausted.
+func retrySchemaOutdated(ctx context.Context, target string, op func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt > schemaOutdatedRetries || !errors.Is(err, schemaOutdatedError) {
+			return err
+		}
+		slog.Warn("Information schema is out of date, retrying", "target", target, "attempt", attempt, "max_retries", schemaOutdatedRetries, "delay", schemaOutdatedDelay)
+		select {
+		case <-time.After(schemaOutdatedDelay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
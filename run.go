@@ -0,0 +1,1236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	"force-rebase-11167/autoid"
+)
+
+// runner runs the tool over the target schemas once main has set it up from
+// the flags: resolving the schemas, reading the table metadata, collecting the
+// max row IDs of the tables, then comparing or rebasing them.
+type runner struct {
+	client   *autoid.Client
+	retry    retrier
+	mode     int
+	modeName string // the -mode flag, labelling the metrics
+	user     string
+	idType   string
+	idColumn string // the -id-column replacing the ID column of every table
+	runStart time.Time
+
+	// Outputs of the run.
+	out       resultWriter
+	sink      io.Writer
+	output    *os.File
+	format    string
+	base      baseline
+	script    *os.File
+	scriptOut string
+	audit     *auditLog
+	done      *checkpoint
+
+	// Target schemas and tables.
+	schemas            []string
+	explicitTables     map[string][]string
+	overrides          map[autoid.TableName]int64
+	allSchemas         bool
+	schemaPattern      *regexp.Regexp
+	allowSystemSchemas bool
+	strict             bool
+	tablePattern       *regexp.Regexp
+	excludePatterns    []string
+	since              time.Duration
+	maxTables          int
+	shardGroups        []shardGroup
+	shardGroupRebase   bool
+
+	// Computation of the AUTO_INCREMENT values.
+	floor       int64
+	buffer      int64
+	minAutoInc  int64
+	unionSize   int
+	scanTimeout time.Duration
+
+	// Concurrency of the collection and the execution.
+	concurrency         int
+	schemaConcurrencies map[string]int
+	totalConcurrency    int // the sum of all the scanning slots
+	schemaConcurrency   int
+	ddlConcurrency      int
+	batchSize           int
+	stream              bool
+
+	// Execution options.
+	yes               bool
+	dryRun            bool
+	verify            bool
+	failFast          bool
+	noProgress        bool
+	onlyErrors        bool
+	cacheFile         string
+	useCache          bool
+	infoSchemaCurrent bool
+	planFile          string
+
+	// Metadata of the tables in the schemas, read before the collection.
+	shardRowIDBits    map[autoid.TableName]uint64
+	idColumns         map[autoid.TableName]string
+	partitionedTables map[autoid.TableName]struct{}
+	clusteredTables   map[autoid.TableName]struct{}
+	autoRandomTables  map[autoid.TableName]uint64
+	updateTimes       map[autoid.TableName]time.Time
+	modifiedAfter     time.Time
+
+	// execCtx lets the statements run to completion even if interrupted, and
+	// ddlSlots bounds the number of tables executed at the same time.
+	execCtx  context.Context
+	ddlSlots chan struct{}
+
+	collectStart time.Time
+	timings      schemaTimings
+	// limitReached is closed once -max-tables tables are collected, to stop
+	// the enumeration. With -stream, the collected tables are sent to streamed
+	// instead of being kept in tableInfos.
+	limitReached chan struct{}
+	streamed     chan autoid.TableInfo
+	// defaultSlots bounds the scans of the schemas without their own slots in
+	// schemaSlots, from -schema-concurrencies.
+	defaultSlots chan struct{}
+	schemaSlots  map[string]chan struct{}
+
+	// The state below is shared by the workers and guarded by mu.
+	mu               sync.Mutex
+	summary          runSummary
+	tableInfos       []autoid.TableInfo
+	collected        int // number of tables admitted towards -max-tables
+	currentIDs       map[autoid.TableName]int64
+	tableCounts      map[string]int    // number of tables per schema in preflight mode
+	rowIDAudit       []rowIDAuditEntry // tables without _tidb_rowid in audit-rowid mode
+	prefetchedMaxIDs map[autoid.TableName]int64
+}
+
+// run runs every phase after connecting, exiting on fatal errors.
+func (r *runner) run(ctx context.Context) {
+	r.resolveSchemas(ctx)
+	r.readMetadata(ctx)
+
+	// Once started, let the statements run to completion even if interrupted,
+	// so we never abandon an ALTER TABLE halfway. Only -timeout aborts them.
+	r.execCtx = context.WithoutCancel(ctx)
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		r.execCtx, cancel = context.WithDeadline(r.execCtx, deadline)
+		defer cancel()
+	}
+	r.ddlSlots = make(chan struct{}, r.ddlConcurrency)
+
+	r.collect(ctx)
+	perSchema := r.schemaConcurrency > 1 && r.mode != modePlan
+	if err := ctx.Err(); err != nil && !r.stream && !perSchema {
+		exitCancelled(err, "No changes were applied while collecting max row IDs.", "scanned", r.summary.Scanned)
+	}
+
+	switch r.mode {
+	case modePreflight:
+		if err := writePreflight(r.sink, r.schemas, r.tableCounts); err != nil {
+			fatal("Error writing preflight result", "error", err)
+		}
+		r.closeOutput()
+		slog.Info("Preflight finished.", "schemas_failed", r.summary.FailedSchemas, "schemas_denied", r.summary.DeniedSchemas, "schemas_empty", r.summary.EmptySchemas, "skipped", r.summary.Skipped)
+		return
+	case modeAuditRowID:
+		if err := writeRowIDAudit(r.sink, r.rowIDAudit); err != nil {
+			fatal("Error writing audit-rowid result", "error", err)
+		}
+		r.closeOutput()
+		slog.Info("Audit finished.", "scanned", r.summary.Scanned, "without_rowid", len(r.rowIDAudit), "errored", r.summary.Errored, "schemas_failed", r.summary.FailedSchemas, "schemas_denied", r.summary.DeniedSchemas)
+		return
+	}
+
+	slog.Info("Finished collecting max row IDs.")
+	r.timings.log(time.Since(r.collectStart))
+	if perSchema {
+		// Each schema was already executed once collected.
+		r.finish(ctx)
+		return
+	}
+	r.tableInfos = r.prepareExecution(ctx, r.schemas, r.tableInfos)
+
+	if r.mode == modePlan {
+		if err := writePlan(r.planFile, r.collectStart, r.tableInfos); err != nil {
+			fatal("Error writing -plan", "error", err)
+		}
+		slog.Info("Plan written, no changes were applied.", "plan", r.planFile, "tables", len(r.tableInfos), "skipped", r.summary.Skipped, "errored", r.summary.Errored)
+		if failed := r.summary.Errored + r.summary.FailedSchemas + r.summary.DeniedSchemas; failed > 0 {
+			fatalWithStatus(exitPartialFailure, "Some schemas or tables failed and are missing from the plan.", "errored", r.summary.Errored, "schemas_failed", r.summary.FailedSchemas, "schemas_denied", r.summary.DeniedSchemas)
+		}
+		return
+	}
+
+	if r.altersTables() && !r.yes && len(r.tableInfos) > 0 {
+		prompt := fmt.Sprintf("About to alter %d tables.", len(r.tableInfos))
+		if r.mode == modeRebaseIfNeeded || r.batchSize == 1 {
+			// Some tables may still turn out to be in sync or have a higher base.
+			prompt = fmt.Sprintf("About to alter up to %d tables.", len(r.tableInfos))
+		}
+		r.confirmRebase(prompt)
+	}
+
+	if !r.stream {
+		slog.Info("Starting execution...")
+	}
+	r.execute(ctx, r.tableInfos)
+	r.finish(ctx)
+}
+
+// altersTables checks if the run executes ALTER statements on the server, as
+// opposed to only comparing, dry-running or writing a script.
+func (r *runner) altersTables() bool {
+	return (r.mode == modeRebase || r.mode == modeRebaseIfNeeded) && !r.dryRun && r.script == nil
+}
+
+// confirmRebase asks the operator to confirm the prompt, exiting if refused.
+func (r *runner) confirmRebase(prompt string) {
+	ok, err := confirm(prompt + " Continue?")
+	if err != nil {
+		fatal("Cannot confirm the rebase", "error", err)
+	}
+	if !ok {
+		fatal("Aborted by user. No changes were applied.")
+	}
+}
+
+// count adds the delta to the summary of the schema, also counting the errors
+// in the metrics.
+func (r *runner) count(schema string, delta runSummary) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.summary.add(schema, delta)
+	if delta.Errored > 0 {
+		errorsCounter.Add(float64(delta.Errored))
+	}
+}
+
+// closeOutput closes the -output file, if any.
+func (r *runner) closeOutput() {
+	if r.output != os.Stdout {
+		if err := r.output.Close(); err != nil {
+			fatal("Error closing output file", "error", err)
+		}
+	}
+}
+
+// resolveSchemas finds all schemas or those matching -schema-regex if
+// requested, and checks that all requested schemas exist, to catch typos early.
+func (r *runner) resolveSchemas(ctx context.Context) {
+	var existingSchemas []string
+	err := r.retry.do(ctx, "information_schema.schemata", func() (err error) {
+		existingSchemas, err = r.client.Schemas(ctx)
+		return err
+	})
+	if err != nil {
+		fatal("Error listing schemas", "error", err)
+	}
+	if r.allSchemas {
+		r.schemas = userSchemas(existingSchemas)
+		slog.Info("Target schemas", "count", len(r.schemas), "schemas", r.schemas)
+	} else if r.schemaPattern != nil {
+		for _, schema := range existingSchemas {
+			if r.schemaPattern.MatchString(schema) {
+				r.schemas = append(r.schemas, schema)
+			}
+		}
+		r.schemas = uniqueStrings(r.schemas)
+		slog.Info("Target schemas", "count", len(r.schemas), "schemas", r.schemas)
+	}
+	if !r.allowSystemSchemas {
+		if kept := userSchemas(r.schemas); len(kept) < len(r.schemas) {
+			var skipped []string
+			for _, schema := range r.schemas {
+				if !slices.Contains(kept, schema) {
+					skipped = append(skipped, schema)
+				}
+			}
+			slog.Warn("Skipping system schemas, pass -allow-system-schemas to process them.", "schemas", skipped)
+			r.schemas = kept
+		}
+	}
+	if len(r.schemas) == 0 {
+		fatal("No schema matched. Check -schemas, -schema-regex and -allow-system-schemas, or that the cluster has any user schema for -all-schemas.")
+	}
+	if missing := missingSchemas(r.schemas, existingSchemas); len(missing) > 0 {
+		if r.strict {
+			fatal("Some schemas do not exist.", "schemas", missing)
+		}
+		slog.Warn("Some schemas do not exist, their tables will be skipped.", "schemas", missing)
+	}
+}
+
+// readMetadata reads what the collection needs to know about the tables of
+// all schemas from information_schema.
+func (r *runner) readMetadata(ctx context.Context) {
+	var err error
+
+	// Obtain the shard_row_id_bits (or auto_random shard bits).
+	if prefix := autoid.ShardingInfoPrefixes[r.idType]; prefix != "" && r.idColumn == "" {
+		r.shardRowIDBits, err = r.client.ShardRowIDBits(ctx, r.schemas, prefix)
+		if err != nil {
+			fatal("Error collecting shard_row_id_bits", "error", err)
+		}
+	}
+
+	// Other than _tidb_rowid, the IDs are stored in a regular column of each
+	// table, which we need to find out first.
+	switch r.idType {
+	case autoid.IDTypeAutoRandom:
+		// AUTO_RANDOM is always on the primary key, and those tables are
+		// exactly those with the PK_AUTO_RANDOM_BITS sharding info.
+		pkColumns, err := r.client.PrimaryKeyColumns(ctx, r.schemas)
+		if err != nil {
+			fatal("Error collecting primary key columns", "error", err)
+		}
+		r.idColumns = make(map[autoid.TableName]string)
+		for name, column := range pkColumns {
+			if _, isAutoRandom := r.shardRowIDBits[name]; isAutoRandom {
+				r.idColumns[name] = column
+			}
+		}
+	case autoid.IDTypeAutoIncrement:
+		r.idColumns, err = r.client.AutoIncrementColumns(ctx, r.schemas)
+		if err != nil {
+			fatal("Error collecting auto_increment columns", "error", err)
+		}
+	}
+
+	// In TiDB all partitions of a table share the same ID allocator, so the
+	// max row ID of the logical table and the ALTER TABLE on it already cover
+	// every partition. We only note these tables to make this transparent.
+	r.partitionedTables, err = r.client.PartitionedTables(ctx, r.schemas)
+	if err != nil {
+		fatal("Error collecting partitioned tables", "error", err)
+	}
+
+	// Tables with a clustered primary key have no _tidb_rowid. They would be
+	// skipped anyway by the unknown column error, but we report them
+	// distinctly. Older TiDB versions without TIDB_PK_TYPE have no such tables.
+	if r.idType == autoid.IDTypeRowID && r.idColumn == "" {
+		r.clusteredTables, err = r.client.ClusteredTables(ctx, r.schemas)
+		if err != nil {
+			slog.Warn("Cannot detect clustered index tables", "error", err)
+		}
+	}
+
+	// The audit-rowid mode further tells the AUTO_RANDOM tables apart from the
+	// other clustered index tables.
+	if r.mode == modeAuditRowID {
+		r.autoRandomTables, err = r.client.ShardRowIDBits(ctx, r.schemas, autoid.ShardingInfoPrefixes[autoid.IDTypeAutoRandom])
+		if err != nil {
+			slog.Warn("Cannot detect AUTO_RANDOM tables", "error", err)
+		}
+	}
+
+	// Tables without a known update time are kept to be safe.
+	if r.since > 0 {
+		r.modifiedAfter = time.Now().Add(-r.since)
+		r.updateTimes, err = r.client.UpdateTimes(ctx, r.schemas)
+		if err != nil {
+			fatal("Error collecting table update times", "error", err)
+		}
+		if len(r.updateTimes) == 0 {
+			slog.Warn("No table reports an update_time, so -since filters nothing.", "since", r.since)
+		}
+	}
+}
+
+// collect finds the max row IDs of the tables. By default, the schemas are
+// listed one by one and their tables fed to the shared scanning workers. With
+// -schema-concurrency, each schema instead goes through its own pipeline. A
+// schema failing to be listed does not affect the others. With -stream, the
+// tables are executed as they are collected.
+func (r *runner) collect(ctx context.Context) {
+	r.collectStart = time.Now()
+	r.tableCounts = make(map[string]int)
+	r.prefetchedMaxIDs = make(map[autoid.TableName]int64)
+	r.limitReached = make(chan struct{})
+
+	// Each listed schema has its own scanning slots, and the unlisted schemas
+	// share the rest.
+	r.defaultSlots = make(chan struct{}, r.concurrency)
+	r.schemaSlots = make(map[string]chan struct{}, len(r.schemaConcurrencies))
+	for schema, n := range r.schemaConcurrencies {
+		r.schemaSlots[schema] = make(chan struct{}, n)
+	}
+
+	if r.schemaConcurrency > 1 {
+		if r.mode != modePlan && r.altersTables() && !r.yes {
+			r.confirmRebase("About to alter the tables of each schema once it is collected, without a count in advance.")
+		}
+		schemaNames := make(chan string)
+		var wg sync.WaitGroup
+		for range r.schemaConcurrency {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for schema := range schemaNames {
+					if ctx.Err() == nil {
+						r.processSchema(ctx, schema)
+					}
+				}
+			}()
+		}
+		for _, schema := range r.schemas {
+			if ctx.Err() != nil {
+				break
+			}
+			schemaNames <- schema
+		}
+		close(schemaNames)
+		wg.Wait()
+		return
+	}
+
+	streamDone := make(chan struct{})
+	if r.stream {
+		r.startStream(ctx, streamDone)
+	} else {
+		close(streamDone)
+	}
+
+	tableNames := make(chan autoid.TableName)
+	var wg sync.WaitGroup
+	for range r.totalConcurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range tableNames {
+				slots := r.scanSlots(name.Schema)
+				slots <- struct{}{}
+				t, ok := r.scanTable(ctx, name)
+				<-slots
+				r.timings.finish(name.Schema)
+				if ok && r.admit() {
+					if r.streamed != nil {
+						r.streamed <- t
+					} else {
+						r.mu.Lock()
+						r.tableInfos = append(r.tableInfos, t)
+						r.mu.Unlock()
+					}
+				}
+			}
+		}()
+	}
+
+	for _, schema := range r.schemas {
+		if ctx.Err() != nil || r.limitIsReached() {
+			break
+		}
+		r.feedSchema(ctx, schema, tableNames)
+	}
+	close(tableNames)
+	wg.Wait()
+	if r.streamed != nil {
+		close(r.streamed)
+	}
+	<-streamDone
+}
+
+// scanSlots returns the scanning slots shared by the tables of the schema.
+func (r *runner) scanSlots(schema string) chan struct{} {
+	if slots, ok := r.schemaSlots[schema]; ok {
+		return slots
+	}
+	return r.defaultSlots
+}
+
+// limitIsReached checks if -max-tables tables were already collected.
+func (r *runner) limitIsReached() bool {
+	select {
+	case <-r.limitReached:
+		return true
+	default:
+		return false
+	}
+}
+
+// startStream starts executing the tables sent to streamed right away instead
+// of keeping them in tableInfos, bounding the memory regardless of the number
+// of tables. done is closed once every streamed table has been executed.
+func (r *runner) startStream(ctx context.Context, done chan<- struct{}) {
+	if r.altersTables() && !r.yes {
+		r.confirmRebase("About to alter the tables as they are collected, without a count in advance.")
+	}
+	slog.Info("Starting execution while collecting the tables...")
+	r.streamed = make(chan autoid.TableInfo, r.ddlConcurrency)
+	go func() {
+		defer close(done)
+		var wg sync.WaitGroup
+		index := 0
+		for t := range r.streamed {
+			if ctx.Err() != nil {
+				continue
+			}
+			r.ddlSlots <- struct{}{}
+			wg.Add(1)
+			go func(index int) {
+				defer func() {
+					<-r.ddlSlots
+					wg.Done()
+				}()
+				r.executeTable(ctx, &t, index, 0, false)
+			}(index)
+			index++
+		}
+		wg.Wait()
+	}()
+}
+
+// feedSchema lists the tables of the schema and sends those to be processed to
+// the scanning workers.
+func (r *runner) feedSchema(ctx context.Context, schema string, tableNames chan<- autoid.TableName) {
+	slog.Info("Processing schema", "schema", schema)
+	r.timings.begin(schema)
+	defer r.timings.finish(schema)
+
+	r.listTables(ctx, schema, func(name autoid.TableName) bool {
+		select {
+		case tableNames <- name:
+			return true
+		case <-ctx.Done():
+			return false
+		case <-r.limitReached:
+			return false
+		}
+	})
+}
+
+// processSchema lists, scans and then executes the tables of the schema on its
+// own, for -schema-concurrency. The tables are still scanned within the slots
+// of -concurrency and executed within the ddlSlots. In the plan mode, the
+// collected tables are kept to be written with those of the other schemas.
+func (r *runner) processSchema(ctx context.Context, schema string) {
+	if r.limitIsReached() {
+		return
+	}
+	slog.Info("Processing schema", "schema", schema)
+	r.timings.begin(schema)
+
+	var (
+		tables []autoid.TableInfo
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+	)
+	slots := r.scanSlots(schema)
+	r.listTables(ctx, schema, func(name autoid.TableName) bool {
+		if ctx.Err() != nil || r.limitIsReached() {
+			return false
+		}
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			if t, ok := r.scanTable(ctx, name); ok && r.admit() {
+				mu.Lock()
+				tables = append(tables, t)
+				mu.Unlock()
+			}
+		}()
+		return true
+	})
+	wg.Wait()
+	r.timings.finish(schema)
+
+	switch r.mode {
+	case modePlan:
+		r.mu.Lock()
+		r.tableInfos = append(r.tableInfos, tables...)
+		r.mu.Unlock()
+	case modeCompare, modeRebase, modeRebaseIfNeeded:
+		if ctx.Err() != nil || len(tables) == 0 {
+			return
+		}
+		slog.Info("Executing schema", "schema", schema, "tables", len(tables))
+		r.execute(ctx, r.prepareExecution(ctx, []string{schema}, tables))
+	}
+}
+
+// listTables passes the tables of the schema to be processed to yield as they
+// are listed, skipping those filtered out by the flags, and stops early if
+// yield returns false. With -union-size, the tables are passed on in batches
+// once their max row IDs are prefetched.
+func (r *runner) listTables(ctx context.Context, schema string, yield func(autoid.TableName) bool) {
+	batchSize := 1
+	if r.prefetches() {
+		// Enough tables for a UNION ALL query in each of the scanning slots.
+		batchSize = r.unionSize * cap(r.scanSlots(schema))
+	}
+	var pending []autoid.TableName
+	stopped := false
+	flush := func() {
+		if batchSize > 1 && len(pending) > 1 {
+			r.prefetchMaxIDs(ctx, schema, pending)
+		}
+		for _, name := range pending {
+			if !yield(name) {
+				stopped = true
+				break
+			}
+		}
+		pending = pending[:0]
+	}
+	listed := 0
+	visit := func(table string) bool {
+		listed++
+		name := autoid.TableName{Schema: schema, Table: table}
+		if r.keepTable(name) {
+			pending = append(pending, name)
+			if len(pending) >= batchSize {
+				flush()
+			}
+		}
+		return !stopped
+	}
+
+	var err, partialErr error
+	if tables, isExplicit := r.explicitTables[schema]; isExplicit {
+		for _, table := range tables {
+			if !visit(table) {
+				break
+			}
+		}
+	} else {
+		err = r.retry.do(ctx, schema, func() error {
+			for table, err := range r.client.Tables(ctx, schema) {
+				if err != nil && listed > 0 {
+					// Retrying would list the tables passed on again.
+					partialErr = err
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				if !visit(table) {
+					return nil
+				}
+			}
+			return nil
+		})
+	}
+	if !stopped && len(pending) > 0 {
+		flush()
+	}
+	r.timings.addTables(schema, listed)
+
+	switch {
+	case isPermissionError(err):
+		slog.Error("User lacks the SELECT/ALTER privileges on schema. Skipping schema.", "user", r.user, "schema", schema, "error", err)
+		r.count(schema, runSummary{DeniedSchemas: 1})
+	case err != nil:
+		slog.Error("Error getting tables for schema. Skipping schema.", "schema", schema, "error", err)
+		r.count(schema, runSummary{FailedSchemas: 1})
+	case partialErr != nil:
+		slog.Error("Error getting the rest of the tables for schema. Skipping the rest of the schema.", "schema", schema, "listed", listed, "error", partialErr)
+		r.count(schema, runSummary{FailedSchemas: 1})
+	case listed == 0:
+		slog.Info("Schema has no tables", "schema", schema)
+		r.count(schema, runSummary{EmptySchemas: 1})
+	}
+}
+
+// keepTable checks if the listed table is to be processed, counting it as
+// skipped if filtered out by the flags.
+func (r *runner) keepTable(name autoid.TableName) bool {
+	if r.tablePattern != nil && !r.tablePattern.MatchString(name.Table) {
+		slog.Debug("Skipping table not matching -table-regex", "schema", name.Schema, "table", name.Table)
+	} else if matchesAny(name, r.excludePatterns) {
+		slog.Debug("Excluding table", "schema", name.Schema, "table", name.Table)
+	} else if updateTime, ok := r.updateTimes[name]; ok && updateTime.Before(r.modifiedAfter) {
+		slog.Debug("Skipping table not modified within -since", "schema", name.Schema, "table", name.Table, "update_time", updateTime)
+	} else if r.done != nil && r.done.has(name) {
+		slog.Debug("Skipping table completed in checkpoint", "schema", name.Schema, "table", name.Table)
+	} else {
+		return true
+	}
+	r.count(name.Schema, runSummary{Skipped: 1})
+	return false
+}
+
+// prefetches checks if the max row IDs are prefetched with -union-size.
+func (r *runner) prefetches() bool {
+	return r.unionSize > 1 && r.overrides == nil && r.floor == 0 && r.mode != modePreflight && r.mode != modeAuditRowID
+}
+
+// idColumnOf returns the ID column whose max is the max row ID of the table,
+// or an empty string if the table has none of its ID type.
+func (r *runner) idColumnOf(name autoid.TableName) string {
+	if r.idColumn != "" {
+		return r.idColumn
+	}
+	if r.idColumns != nil {
+		return r.idColumns[name]
+	}
+	return "_tidb_rowid"
+}
+
+// prefetchMaxIDs finds the max IDs of the tables with UNION ALL queries of up
+// to -union-size tables sharing the same ID column, running the queries within
+// the scanning slots of the schema. Only the tables still within -max-tables
+// are prefetched. A failed query leaves the max IDs of its tables to be found
+// one by one.
+func (r *runner) prefetchMaxIDs(ctx context.Context, schema string, names []autoid.TableName) {
+	if r.maxTables > 0 {
+		r.mu.Lock()
+		remaining := max(r.maxTables-r.collected, 0)
+		r.mu.Unlock()
+		names = names[:min(len(names), remaining)]
+	}
+
+	// The clustered index tables have no _tidb_rowid and would fail the whole
+	// UNION of their chunk, like the tables without the ID column.
+	byColumn := make(map[string][]string)
+	var columns []string
+	for _, name := range names {
+		column := r.idColumnOf(name)
+		if _, isClustered := r.clusteredTables[name]; column == "" || isClustered {
+			continue
+		}
+		if _, ok := byColumn[column]; !ok {
+			columns = append(columns, column)
+		}
+		byColumn[column] = append(byColumn[column], name.Table)
+	}
+
+	slots := r.scanSlots(schema)
+	var wg sync.WaitGroup
+	for _, column := range columns {
+		for tables := range slices.Chunk(byColumn[column], r.unionSize) {
+			if ctx.Err() != nil || r.limitIsReached() {
+				break
+			}
+			slots <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer func() {
+					<-slots
+					wg.Done()
+				}()
+				r.prefetchChunk(ctx, schema, tables, column)
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+// prefetchChunk finds the max IDs of the tables with a single UNION ALL query.
+func (r *runner) prefetchChunk(ctx context.Context, schema string, tables []string, column string) {
+	var maxIDs map[string]int64
+	err := r.retry.do(ctx, schema, func() (err error) {
+		defer observeQuery("max_row_ids", time.Now())
+		scanCtx := ctx
+		if r.scanTimeout > 0 {
+			var cancel context.CancelFunc
+			scanCtx, cancel = context.WithTimeout(ctx, r.scanTimeout)
+			defer cancel()
+		}
+		maxIDs, err = r.client.MaxRowIDs(scanCtx, schema, tables, column, r.shardRowIDBits)
+		return err
+	})
+	if err != nil {
+		slog.Debug("Falling back to per-table max row ID queries", "schema", schema, "tables", len(tables), "error", err)
+		return
+	}
+	r.mu.Lock()
+	for table, maxID := range maxIDs {
+		r.prefetchedMaxIDs[autoid.TableName{Schema: schema, Table: table}] = maxID
+	}
+	r.mu.Unlock()
+}
+
+// admit counts the collected table towards -max-tables, returning false if
+// the limit was already reached.
+func (r *runner) admit() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.maxTables > 0 && r.collected >= r.maxTables {
+		return false
+	}
+	r.collected++
+	if r.collected == r.maxTables {
+		slog.Info("Reached -max-tables, not collecting more tables.", "max_tables", r.maxTables)
+		close(r.limitReached)
+	}
+	return true
+}
+
+// scanTable finds the max row ID of the table and returns it with the
+// AUTO_INCREMENT value to rebase to if it is to be executed, or only counts or
+// probes it in the preflight and audit-rowid modes.
+func (r *runner) scanTable(ctx context.Context, name autoid.TableName) (autoid.TableInfo, bool) {
+	select {
+	case <-ctx.Done():
+		return autoid.TableInfo{}, false
+	case <-r.limitReached:
+		return autoid.TableInfo{}, false
+	default:
+	}
+	if r.mode == modePreflight {
+		// Count only the tables a real run would process under -max-tables.
+		if !r.admit() {
+			return autoid.TableInfo{}, false
+		}
+		r.mu.Lock()
+		r.tableCounts[name.Schema]++
+		r.mu.Unlock()
+		return autoid.TableInfo{}, false
+	}
+	if r.mode == modeAuditRowID {
+		r.auditTable(ctx, name)
+		return autoid.TableInfo{}, false
+	}
+	if autoInc, ok := r.overrides[name]; ok {
+		return autoid.TableInfo{TableName: name, AutoInc: autoInc, IDType: r.idType}, true
+	}
+	if r.floor > 0 {
+		return autoid.TableInfo{TableName: name, AutoInc: r.floor, IDType: r.idType}, true
+	}
+	column := r.idColumnOf(name)
+	if column == "" {
+		slog.Debug("Skipping table without ID column", "schema", name.Schema, "table", name.Table, "id_type", r.idType)
+		r.count(name.Schema, runSummary{Skipped: 1})
+		return autoid.TableInfo{}, false
+	}
+	if _, ok := r.clusteredTables[name]; ok {
+		if r.client.StrictRowID {
+			slog.Error("Table has no _tidb_rowid because of its clustered index", "schema", name.Schema, "table", name.Table)
+			r.count(name.Schema, runSummary{Errored: 1})
+		} else {
+			slog.Debug("Skipping clustered index table without _tidb_rowid", "schema", name.Schema, "table", name.Table)
+			r.count(name.Schema, runSummary{Clustered: 1})
+		}
+		return autoid.TableInfo{}, false
+	}
+	if _, ok := r.partitionedTables[name]; ok {
+		slog.Info("Table is partitioned, finding the max ID across all partitions", "schema", name.Schema, "table", name.Table)
+	}
+	r.mu.Lock()
+	maxID, isPrefetched := r.prefetchedMaxIDs[name]
+	r.mu.Unlock()
+	var err error
+	timedOut := false // the scan exceeded -scan-timeout, not the whole run
+	if !isPrefetched {
+		err = r.retry.do(ctx, name.Schema+"."+name.Table, func() (err error) {
+			defer observeQuery("max_row_id", time.Now())
+			scanCtx := ctx
+			if r.scanTimeout > 0 {
+				var cancel context.CancelFunc
+				scanCtx, cancel = context.WithTimeout(ctx, r.scanTimeout)
+				defer cancel()
+			}
+			maxID, err = r.client.MaxRowID(scanCtx, name.Schema, name.Table, column, r.shardRowIDBits[name])
+			timedOut = err != nil && errors.Is(scanCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil
+			return err
+		})
+	}
+	r.count(name.Schema, runSummary{Scanned: 1})
+	if maxID == 0 {
+		switch {
+		case errors.Is(err, autoid.ErrTableNotExist):
+			slog.Warn("Skipping table which no longer exists", "schema", name.Schema, "table", name.Table, "error", err)
+			r.count(name.Schema, runSummary{Skipped: 1})
+		case timedOut:
+			slog.Warn("Skipping table whose max row ID scan exceeded -scan-timeout", "schema", name.Schema, "table", name.Table, "scan_timeout", r.scanTimeout, "error", err)
+			r.count(name.Schema, runSummary{Skipped: 1})
+		case errors.Is(err, autoid.ErrNoIDColumn):
+			slog.Error("Table unexpectedly has no ID column", "schema", name.Schema, "table", name.Table, "column", column)
+			r.count(name.Schema, runSummary{Errored: 1})
+		case err != nil:
+			slog.Warn("Skipping table", "schema", name.Schema, "table", name.Table, "error", err)
+			r.count(name.Schema, runSummary{Errored: 1})
+		case r.shardGroupRebase && shardGroupOf(name, r.shardGroups) != "":
+			// An empty shard is still given the combined value of its group.
+			return autoid.TableInfo{TableName: name, IDType: r.idType}, true
+		default:
+			slog.Debug("Skipping table without row ID", "schema", name.Schema, "table", name.Table)
+			r.count(name.Schema, runSummary{Skipped: 1})
+		}
+		return autoid.TableInfo{}, false
+	}
+
+	autoInc, err := computeAutoInc(maxID, r.buffer)
+	if err != nil {
+		slog.Error("Refusing to rebase table", "schema", name.Schema, "table", name.Table, "error", err)
+		r.count(name.Schema, runSummary{Errored: 1})
+		return autoid.TableInfo{}, false
+	}
+
+	// The -min-autoinc of a shard group is checked on its combined value.
+	if autoInc < r.minAutoInc && !(r.shardGroupRebase && shardGroupOf(name, r.shardGroups) != "") {
+		slog.Debug("Skipping table below -min-autoinc", "schema", name.Schema, "table", name.Table, "auto_inc", autoInc)
+		r.count(name.Schema, runSummary{Skipped: 1})
+		return autoid.TableInfo{}, false
+	}
+
+	// Store the valid result
+	return autoid.TableInfo{TableName: name, AutoInc: autoInc, IDType: r.idType}, true
+}
+
+// auditTable probes whether the table has a _tidb_rowid in audit-rowid mode,
+// recording it with the reason if not.
+func (r *runner) auditTable(ctx context.Context, name autoid.TableName) {
+	var hasRowID bool
+	err := r.retry.do(ctx, name.Schema+"."+name.Table, func() (err error) {
+		hasRowID, err = r.client.HasRowID(ctx, name.Schema, name.Table)
+		return err
+	})
+	r.count(name.Schema, runSummary{Scanned: 1})
+	switch {
+	case errors.Is(err, autoid.ErrTableNotExist):
+		slog.Warn("Skipping table which no longer exists", "schema", name.Schema, "table", name.Table, "error", err)
+		r.count(name.Schema, runSummary{Skipped: 1})
+	case err != nil:
+		slog.Warn("Error probing _tidb_rowid", "schema", name.Schema, "table", name.Table, "error", err)
+		r.count(name.Schema, runSummary{Errored: 1})
+	case !hasRowID:
+		category := rowIDCategoryOther
+		if _, ok := r.autoRandomTables[name]; ok {
+			category = rowIDCategoryAutoRandom
+		} else if _, ok := r.clusteredTables[name]; ok {
+			category = rowIDCategoryClustered
+		}
+		r.mu.Lock()
+		r.rowIDAudit = append(r.rowIDAudit, rowIDAuditEntry{TableName: name, Category: category})
+		r.mu.Unlock()
+	}
+}
+
+// prepareExecution completes the tables collected from the schemas before
+// executing them: combining the shard groups, saving the cache, reading the
+// current IDs with -infoschema-current, and skipping the tables whose base is
+// already higher where that must be known in advance.
+func (r *runner) prepareExecution(ctx context.Context, schemas []string, tables []autoid.TableInfo) []autoid.TableInfo {
+	if len(r.shardGroups) > 0 {
+		var dropped []autoid.TableInfo
+		tables, dropped = applyShardGroups(tables, r.shardGroups, r.shardGroupRebase, r.minAutoInc)
+		for _, t := range dropped {
+			slog.Debug("Skipping shard whose group is empty or below -min-autoinc", "schema", t.Schema, "table", t.Table)
+			r.count(t.Schema, runSummary{Skipped: 1})
+		}
+	}
+
+	if r.cacheFile != "" && !r.useCache {
+		if err := writeScanCache(r.cacheFile, r.collectStart, tables); err != nil {
+			fatal("Error writing -cache-file", "error", err)
+		}
+		slog.Info("Saved the collected tables to the cache.", "cache_file", r.cacheFile, "tables", len(tables))
+	}
+
+	if r.infoSchemaCurrent && r.mode != modeRebase && r.mode != modePlan {
+		var currentIDs map[autoid.TableName]int64
+		err := r.retry.do(ctx, "information_schema.tables", func() (err error) {
+			currentIDs, err = r.client.AutoIncrementValues(ctx, schemas)
+			return err
+		})
+		if err != nil {
+			fatal("Error collecting current auto_increment values", "error", err)
+		}
+		r.mu.Lock()
+		if r.currentIDs == nil {
+			r.currentIDs = make(map[autoid.TableName]int64, len(currentIDs))
+		}
+		maps.Copy(r.currentIDs, currentIDs)
+		r.mu.Unlock()
+	}
+
+	// The plan and the batches need the tables whose current base is already
+	// higher to be skipped in advance. Otherwise executeTable checks them.
+	if r.mode == modePlan || (r.mode == modeRebase && r.batchSize > 1) {
+		tables = r.keepLowerBases(ctx, tables)
+		if err := ctx.Err(); err != nil {
+			exitCancelled(err, "No changes were applied while reading the current bases.")
+		}
+	}
+	return tables
+}
+
+// baseIsHigher checks if the current base of the table is already higher than
+// the intended value. TiDB never lowers the base, so such a table is skipped in
+// rebase mode to let the operator know the ALTER was intentionally not
+// attempted. It is run holding one of the ddlSlots.
+func (r *runner) baseIsHigher(ctx context.Context, t *autoid.TableInfo) bool {
+	var current int64
+	var found bool
+	err := r.retry.do(ctx, t.Schema+"."+t.Table, func() (err error) {
+		current, found, err = r.client.NextGlobalRowID(r.execCtx, t)
+		return err
+	})
+	if err != nil {
+		slog.Warn("Cannot read the current base, rebasing anyway", "schema", t.Schema, "table", t.Table, "error", err)
+		return false
+	}
+	if !found || t.AutoInc >= current {
+		return false
+	}
+	slog.Warn("Skipping table whose current base is higher than the intended value", "schema", t.Schema, "table", t.Table, "current", current, "intended", t.AutoInc)
+	r.count(t.Schema, runSummary{Skipped: 1})
+	return true
+}
+
+// keepLowerBases drops the tables whose current base is already higher,
+// checking them concurrently within the ddlSlots.
+func (r *runner) keepLowerBases(ctx context.Context, tables []autoid.TableInfo) []autoid.TableInfo {
+	higher := make([]bool, len(tables))
+	var checkWG sync.WaitGroup
+	for i := range tables {
+		r.ddlSlots <- struct{}{}
+		checkWG.Add(1)
+		go func() {
+			defer func() {
+				<-r.ddlSlots
+				checkWG.Done()
+			}()
+			higher[i] = ctx.Err() == nil && r.baseIsHigher(ctx, &tables[i])
+		}()
+	}
+	checkWG.Wait()
+	kept := tables[:0]
+	for i, t := range tables {
+		if !higher[i] {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
+
+// execute compares and/or rebases the tables, up to -ddl-concurrency at the
+// same time, and waits for all of them.
+func (r *runner) execute(ctx context.Context, tables []autoid.TableInfo) {
+	var wg sync.WaitGroup
+	for start := 0; start < len(tables) && ctx.Err() == nil; start += r.batchSize {
+		batch := tables[start:min(start+r.batchSize, len(tables))]
+
+		// Try to rebase the whole batch in one round trip first. If anything
+		// failed, fall back to rebasing the tables one by one to tell which
+		// statement had the error. Repeating the successful ones is harmless.
+		batchApplied := false
+		if r.mode == modeRebase && len(batch) > 1 && r.script == nil && r.audit == nil {
+			r.ddlSlots <- struct{}{}
+			began := time.Now()
+			batchApplied = r.client.Rebase(r.execCtx, batch, r.dryRun) == nil
+			observeQuery("rebase_batch", began)
+			<-r.ddlSlots
+		}
+
+		for i := range batch {
+			if !batchApplied && ctx.Err() != nil {
+				break
+			}
+			r.ddlSlots <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer func() {
+					<-r.ddlSlots
+					wg.Done()
+				}()
+				r.executeTable(ctx, &batch[i], start+i, len(tables), batchApplied)
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+// executeTable compares and/or rebases the table, the index-th of total tables
+// (0 if unknown while streaming). It is run in a goroutine holding one of the
+// ddlSlots. If batchApplied, its batch was already rebased.
+func (r *runner) executeTable(ctx context.Context, t *autoid.TableInfo, index, total int, batchApplied bool) {
+	if !r.noProgress {
+		progress := fmt.Sprintf("[%d/%d]", index+1, total)
+		if total == 0 {
+			progress = fmt.Sprintf("[%d]", index+1)
+		}
+		slog.Info("Processing table", "progress", progress, "schema", t.Schema, "table", t.Table)
+	}
+	// The batches were already checked before being rebased together.
+	if r.mode == modeRebase && r.batchSize == 1 && r.baseIsHigher(ctx, t) {
+		return
+	}
+	var err error
+	needsRebase := r.mode == modeRebase
+	if r.mode == modeCompare || r.mode == modeRebaseIfNeeded {
+		var result *autoid.CompareResult
+		result, err = r.compareTable(ctx, t)
+		needsRebase = r.mode == modeRebaseIfNeeded && err == nil && result != nil && result.Status == autoid.StatusError
+	}
+	if needsRebase {
+		err = r.rebaseTable(ctx, t, batchApplied)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		slog.Error("Error executing", "schema", t.Schema, "table", t.Table, "error", err)
+		r.summary.add(t.Schema, runSummary{Errored: 1})
+		errorsCounter.Inc()
+		if r.failFast {
+			r.summary.log(r.mode, r.dryRun || r.script != nil)
+			fatalWithStatus(exitPartialFailure, "Stopped at the first error because of -fail-fast.", "schema", t.Schema, "table", t.Table)
+		}
+	}
+	r.summary.add(t.Schema, runSummary{Processed: 1})
+	tablesProcessedCounter.WithLabelValues(r.modeName).Inc()
+	if total > 0 && r.schemaConcurrency <= 1 {
+		progressGauge.Set(float64(r.summary.Processed) / float64(total))
+	}
+}
+
+// compareTable compares the current ID of the table against the expected
+// value, writing and counting the result. The result may be returned together
+// with an error writing it.
+func (r *runner) compareTable(ctx context.Context, t *autoid.TableInfo) (*autoid.CompareResult, error) {
+	// information_schema.tables only has the AUTO_INCREMENT value of tables
+	// with an AUTO_INCREMENT column, so the others still go through SHOW
+	// TABLE NEXT_ROW_ID.
+	var result *autoid.CompareResult
+	r.mu.Lock()
+	current, ok := r.currentIDs[t.TableName]
+	r.mu.Unlock()
+	if ok {
+		result = r.client.CompareCurrent(t, current)
+	} else {
+		err := r.retry.do(ctx, t.Schema+"."+t.Table, func() (err error) {
+			defer observeQuery("compare", time.Now())
+			result, err = r.client.Compare(r.execCtx, t)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if r.base != nil {
+		result.Drift = r.base.drift(result)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var err error
+	if !r.onlyErrors || result.Status == autoid.StatusError {
+		if err = r.out.WriteResult(result); err != nil {
+			err = fmt.Errorf("writing result: %w", err)
+		}
+	}
+	switch result.Status {
+	case autoid.StatusOK:
+		r.summary.add(t.Schema, runSummary{OK: 1})
+		if r.mode == modeRebaseIfNeeded {
+			slog.Info("Not rebasing table already in sync", "schema", t.Schema, "table", t.Table)
+		}
+	case autoid.StatusError:
+		r.summary.add(t.Schema, runSummary{Mismatched: 1})
+	case autoid.StatusNoRowID:
+		r.summary.add(t.Schema, runSummary{NoRowID: 1})
+	case autoid.StatusHigh:
+		r.summary.add(t.Schema, runSummary{High: 1})
+	}
+	return result, err
+}
+
+// rebaseTable rebases the table, or writes its statement to the -script-out
+// file, then verifies and checkpoints it. If batchApplied, the table was
+// already rebased with its batch.
+func (r *runner) rebaseTable(ctx context.Context, t *autoid.TableInfo, batchApplied bool) error {
+	target := t.Schema + "." + t.Table
+	var err error
+	if r.script != nil {
+		r.mu.Lock()
+		err = writeScriptStatement(r.script, t)
+		r.mu.Unlock()
+	} else if !batchApplied {
+		var oldValue *int64
+		if r.audit != nil && !r.dryRun {
+			if current, found, err := r.client.NextGlobalRowID(r.execCtx, t); err == nil && found {
+				oldValue = &current
+			}
+		}
+		err = retrySchemaOutdated(ctx, target, func() error {
+			return r.retry.do(ctx, target, func() error {
+				defer observeQuery("rebase", time.Now())
+				return r.client.Rebase(r.execCtx, []autoid.TableInfo{*t}, r.dryRun)
+			})
+		})
+		if r.audit != nil && !r.dryRun {
+			r.mu.Lock()
+			auditErr := r.audit.record(t, oldValue, err)
+			r.mu.Unlock()
+			if auditErr != nil {
+				fatal("Error writing audit log", "error", auditErr)
+			}
+		}
+	}
+	if err == nil && r.verify && !r.dryRun && r.script == nil {
+		err = r.client.Verify(r.execCtx, t)
+	}
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.done != nil && !r.dryRun && r.script == nil {
+		if err := r.done.add(t.TableName); err != nil {
+			return err
+		}
+	}
+	r.summary.add(t.Schema, runSummary{Rebased: 1})
+	return nil
+}
+
+// finish reports the summary, closes the outputs and exits with the status
+// reflecting the outcome of the run.
+func (r *runner) finish(ctx context.Context) {
+	r.summary.log(r.mode, r.dryRun || r.script != nil)
+	if r.format == "json" {
+		if err := r.summary.writeJSON(r.sink, time.Since(r.runStart)); err != nil {
+			fatal("Error writing summary", "error", err)
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		exitCancelled(err, "Stopped execution.", "processed", r.summary.Processed, "total", r.collected)
+	}
+
+	r.closeOutput()
+	if r.script != nil {
+		if err := r.script.Close(); err != nil {
+			fatal("Error closing script file", "error", err)
+		}
+	}
+
+	if r.mode != modeCompare && r.dryRun {
+		slog.Info("Execution finished (dry run, no changes were applied).")
+	} else if r.script != nil {
+		slog.Info("Execution finished (statements written to script, no changes were applied).", "script", r.scriptOut)
+	} else {
+		slog.Info("Execution finished.")
+	}
+
+	if failed := r.summary.Errored + r.summary.FailedSchemas + r.summary.DeniedSchemas; failed > 0 {
+		fatalWithStatus(exitPartialFailure, "Some schemas or tables failed.", "errored", r.summary.Errored, "schemas_failed", r.summary.FailedSchemas, "schemas_denied", r.summary.DeniedSchemas)
+	}
+
+	if r.strict && r.mode == modeCompare && r.summary.Mismatched > 0 {
+		fatalWithStatus(exitMismatch, "Some tables have NEXT_GLOBAL_ROW_ID below the expected value.", "count", r.summary.Mismatched)
+	}
+}
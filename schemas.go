@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// MySQL error codes caused by the user lacking privileges.
+var (
+	dbAccessDeniedError    = &mysql.MySQLError{Number: 1044}
+	tableAccessDeniedError = &mysql.MySQLError{Number: 1142}
+)
+
+// isPermissionError checks if the error is caused by the user lacking
+// privileges on the schema or table.
+func isPermissionError(err error) bool {
+	return errors.Is(err, dbAccessDeniedError) || errors.Is(err, tableAccessDeniedError)
+}
+
+// parseSchemaList splits a comma-separated list of schema names, trimming
+// whitespace and dropping empty and duplicated entries.
+func parseSchemaList(list string) []string {
+	var schemas []string
+	for _, schema := range strings.Split(list, ",") {
+		if schema = strings.TrimSpace(schema); schema != "" {
+			schemas = append(schemas, schema)
+		}
+	}
+	return uniqueStrings(schemas)
+}
+
+// parseSchemaValues parses a comma-separated list of `schema=value` entries
+// with parse. A bare value without `schema=` replaces fallback as the value of
+// the unlisted schemas.
+func parseSchemaValues[T any](list string, fallback T, parse func(string) (T, error)) (T, map[string]T, error) {
+	values := make(map[string]T)
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		schema, value, found := strings.Cut(entry, "=")
+		v, err := parse(strings.TrimSpace(value))
+		if !found {
+			v, err = parse(entry)
+		}
+		if err != nil {
+			return fallback, nil, fmt.Errorf("invalid value in '%s': %w", entry, err)
+		}
+		if !found {
+			fallback = v
+		} else if schema = strings.TrimSpace(schema); schema == "" {
+			return fallback, nil, fmt.Errorf("empty schema name in '%s'", entry)
+		} else {
+			values[schema] = v
+		}
+	}
+	return fallback, values, nil
+}
+
+// readSchemasFile reads schema names from a file with one name per line.
+// Surrounding whitespace is trimmed, and blank lines and lines starting with
+// `#` are ignored.
+func readSchemasFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening schemas file: %w", err)
+	}
+	defer f.Close()
+
+	var schemas []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		schemas = append(schemas, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading schemas file: %w", err)
+	}
+	return schemas, nil
+}
+
+// uniqueStrings removes duplicated elements, keeping the first occurrence.
+func uniqueStrings(list []string) []string {
+	seen := make(map[string]struct{}, len(list))
+	result := list[:0]
+	for _, s := range list {
+		if _, ok := seen[s]; ok {
+			continue
+		}
+		seen[s] = struct{}{}
+		result = append(result, s)
+	}
+	return result
+}
+
+// missingSchemas returns the requested schemas not found among the existing
+// ones. Schema names are compared case-insensitively like in TiDB.
+func missingSchemas(requested, existing []string) []string {
+	exists := make(map[string]struct{}, len(existing))
+	for _, s := range existing {
+		exists[strings.ToLower(s)] = struct{}{}
+	}
+	var missing []string
+	for _, s := range requested {
+		if _, ok := exists[strings.ToLower(s)]; !ok {
+			missing = append(missing, s)
+		}
+	}
+	return missing
+}
+
+// systemSchemas are the built-in schemas skipped unless -allow-system-schemas.
+var systemSchemas = map[string]struct{}{
+	"information_schema": {},
+	"mysql":              {},
+	"performance_schema": {},
+	"sys":                {},
+	"metrics_schema":     {},
+}
+
+// userSchemas filters out the system schemas.
+func userSchemas(schemas []string) []string {
+	var result []string
+	for _, s := range schemas {
+		if _, ok := systemSchemas[strings.ToLower(s)]; !ok {
+			result = append(result, s)
+		}
+	}
+	return result
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"force-rebase-11167/autoid"
+)
+
+// writeScriptHeader writes the comment heading the SQL script generated by
+// -script-out.
+func writeScriptHeader(w io.Writer, target string, now time.Time) error {
+	_, err := fmt.Fprintf(w, "-- Generated by force-rebase at %s\n-- Target: %s\n", now.Format(time.RFC3339), target)
+	return err
+}
+
+// writeScriptStatement writes the ALTER TABLE statement rebasing the table to
+// the SQL script.
+func writeScriptStatement(w io.Writer, t *autoid.TableInfo) error {
+	if _, err := fmt.Fprintf(w, "%s;\n", autoid.RebaseStatement(t)); err != nil {
+		return fmt.Errorf("writing script: %w", err)
+	}
+	return nil
+}
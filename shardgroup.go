@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"path"
+	"strings"
+
+	"force-rebase-11167/autoid"
+)
+
+// shardGroup is a set of tables sharding one logical table, e.g. `orders_0`
+// to `orders_15`, whose IDs may need to be unique across all of them.
+type shardGroup struct {
+	name    string
+	pattern string // lower-cased glob pattern of `schema.table`
+}
+
+// parseShardGroups parses a comma-separated list of `name=pattern` entries,
+// where the pattern is a glob of `schema.table` like in -exclude-tables.
+func parseShardGroups(list string) ([]shardGroup, error) {
+	var groups []shardGroup
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		name, pattern, found := strings.Cut(entry, "=")
+		name, pattern = strings.TrimSpace(name), strings.ToLower(strings.TrimSpace(pattern))
+		if !found || name == "" || pattern == "" {
+			return nil, fmt.Errorf("shard group '%s' is not in the 'name=pattern' format", entry)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("pattern of shard group '%s': %w", name, err)
+		}
+		groups = append(groups, shardGroup{name: name, pattern: pattern})
+	}
+	return groups, nil
+}
+
+// shardGroupOf returns the name of the first group the table belongs to, or
+// an empty string if none.
+func shardGroupOf(n autoid.TableName, groups []shardGroup) string {
+	fullName := strings.ToLower(n.Schema + "." + n.Table)
+	for _, g := range groups {
+		if matched, _ := path.Match(g.pattern, fullName); matched {
+			return g.name
+		}
+	}
+	return ""
+}
+
+// applyShardGroups logs the combined AutoInc of each group, i.e. the max of
+// its members. If rebase is true, every member is set to the combined value,
+// and the members of groups whose combined value is below minAutoInc are
+// removed and returned separately.
+func applyShardGroups(tables []autoid.TableInfo, groups []shardGroup, rebase bool, minAutoInc int64) (kept, dropped []autoid.TableInfo) {
+	combined := make(map[string]int64)
+	members := make(map[string]int)
+	for _, t := range tables {
+		if group := shardGroupOf(t.TableName, groups); group != "" {
+			combined[group] = max(combined[group], t.AutoInc)
+			members[group]++
+		}
+	}
+	for _, g := range groups {
+		slog.Info("Shard group", "group", g.name, "members", members[g.name], "combined_auto_inc", combined[g.name])
+	}
+	if !rebase {
+		return tables, nil
+	}
+
+	kept = tables[:0]
+	for _, t := range tables {
+		if group := shardGroupOf(t.TableName, groups); group != "" {
+			if combined[group] < max(minAutoInc, 1) {
+				dropped = append(dropped, t)
+				continue
+			}
+			t.AutoInc = combined[group]
+		}
+		kept = append(kept, t)
+	}
+	return kept, dropped
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// runSummary accumulates the number of tables in each outcome of a run.
+type runSummary struct {
+	FailedSchemas int `json:"schemas_failed"` // schemas whose tables could not be listed
+	DeniedSchemas int `json:"schemas_denied"` // schemas skipped because of missing privileges
+	EmptySchemas  int `json:"schemas_empty"`  // schemas without any tables
+	Scanned       int `json:"scanned"`        // tables whose max row ID was queried
+	Skipped       int `json:"skipped"`        // tables excluded, checkpointed, without IDs, or with low max IDs
+	Clustered     int `json:"clustered"`      // tables skipped for having a clustered index, thus no _tidb_rowid
+	Errored       int `json:"errored"`        // tables failed either in the scan or the execution
+	Processed     int `json:"processed"`      // tables reaching the execution phase
+	Rebased       int `json:"rebased"`        // tables successfully rebased
+	OK            int `json:"ok"`             // tables reported "ok" by the comparison
+	Mismatched    int `json:"mismatched"`     // tables reported "ERROR" by the comparison
+	NoRowID       int `json:"no_rowid"`       // tables reported "no-rowid" by the comparison
+	High          int `json:"high"`           // tables reported "HIGH" by the comparison
+
+	bySchema map[string]*runSummary // breakdown of the counts by schema
+}
+
+// add adds the counts in delta to the totals and to the breakdown of the
+// schema.
+func (s *runSummary) add(schema string, delta runSummary) {
+	s.plus(&delta)
+	if s.bySchema == nil {
+		s.bySchema = make(map[string]*runSummary)
+	}
+	schemaSummary, ok := s.bySchema[schema]
+	if !ok {
+		schemaSummary = new(runSummary)
+		s.bySchema[schema] = schemaSummary
+	}
+	schemaSummary.plus(&delta)
+}
+
+// plus adds the counts in delta to s, except the breakdown.
+func (s *runSummary) plus(delta *runSummary) {
+	s.FailedSchemas += delta.FailedSchemas
+	s.DeniedSchemas += delta.DeniedSchemas
+	s.EmptySchemas += delta.EmptySchemas
+	s.Scanned += delta.Scanned
+	s.Skipped += delta.Skipped
+	s.Clustered += delta.Clustered
+	s.Errored += delta.Errored
+	s.Processed += delta.Processed
+	s.Rebased += delta.Rebased
+	s.OK += delta.OK
+	s.Mismatched += delta.Mismatched
+	s.NoRowID += delta.NoRowID
+	s.High += delta.High
+}
+
+// log prints the summary to the log stream, preceded by the breakdown by
+// schema if there are multiple schemas.
+func (s *runSummary) log(mode int, dryRun bool) {
+	if len(s.bySchema) > 1 {
+		schemas := make([]string, 0, len(s.bySchema))
+		for schema := range s.bySchema {
+			schemas = append(schemas, schema)
+		}
+		slices.Sort(schemas)
+		for _, schema := range schemas {
+			attrs := append([]any{"schema", schema}, s.bySchema[schema].attrs(mode, dryRun)...)
+			slog.Info("Schema summary", attrs...)
+		}
+	}
+	slog.Info("Summary", s.attrs(mode, dryRun)...)
+}
+
+// attrs returns the counts relevant to the mode as log attributes.
+func (s *runSummary) attrs(mode int, dryRun bool) []any {
+	attrs := []any{
+		"schemas_failed", s.FailedSchemas,
+		"schemas_denied", s.DeniedSchemas,
+		"schemas_empty", s.EmptySchemas,
+		"scanned", s.Scanned,
+		"skipped", s.Skipped,
+		"clustered", s.Clustered,
+		"errored", s.Errored,
+		"processed", s.Processed,
+	}
+	switch mode {
+	case modeRebase:
+		attrs = append(attrs, "rebased", s.Rebased, "dry_run", dryRun)
+	case modeCompare:
+		attrs = append(attrs, "ok", s.OK, "mismatched", s.Mismatched, "no_rowid", s.NoRowID, "high", s.High)
+	case modeRebaseIfNeeded:
+		attrs = append(attrs, "ok", s.OK, "mismatched", s.Mismatched, "no_rowid", s.NoRowID, "high", s.High, "rebased", s.Rebased, "dry_run", dryRun)
+	}
+	return attrs
+}
+
+// writeJSON writes the summary as a single `{"summary": {...}}` line, with the
+// duration of the whole run in seconds.
+func (s *runSummary) writeJSON(w io.Writer, elapsed time.Duration) error {
+	record := struct {
+		runSummary
+		DurationSeconds float64 `json:"duration_seconds"`
+	}{*s, elapsed.Seconds()}
+	return json.NewEncoder(w).Encode(map[string]any{"summary": record})
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"cmp"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// schemaTiming is the wall-clock time spent on a schema in the collection
+// phase, from listing its tables to scanning the last one.
+type schemaTiming struct {
+	schema string
+	start  time.Time
+	end    time.Time
+	tables int
+}
+
+// schemaTimings records the schemaTiming of every schema. It is safe for
+// concurrent use.
+type schemaTimings struct {
+	mu       sync.Mutex
+	bySchema map[string]*schemaTiming
+}
+
+// get returns the timing of the schema, creating it if needed. Must be called
+// with mu locked.
+func (t *schemaTimings) get(schema string) *schemaTiming {
+	if t.bySchema == nil {
+		t.bySchema = make(map[string]*schemaTiming)
+	}
+	timing, ok := t.bySchema[schema]
+	if !ok {
+		now := time.Now()
+		timing = &schemaTiming{schema: schema, start: now, end: now}
+		t.bySchema[schema] = timing
+	}
+	return timing
+}
+
+// begin marks the start of processing the schema.
+func (t *schemaTimings) begin(schema string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.get(schema)
+}
+
+// addTables counts the tables listed from the schema.
+func (t *schemaTimings) addTables(schema string, n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.get(schema).tables += n
+}
+
+// finish marks the schema as processed up to now.
+func (t *schemaTimings) finish(schema string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.get(schema).end = time.Now()
+}
+
+// log prints the total time of the collection phase, followed by the time
+// spent on each schema from the slowest to the fastest.
+func (t *schemaTimings) log(total time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	timings := make([]*schemaTiming, 0, len(t.bySchema))
+	for _, timing := range t.bySchema {
+		timings = append(timings, timing)
+	}
+	slices.SortFunc(timings, func(a, b *schemaTiming) int {
+		return cmp.Compare(b.end.Sub(b.start), a.end.Sub(a.start))
+	})
+	slog.Info("Collection time", "elapsed", total, "schemas", len(timings))
+	for _, timing := range timings {
+		slog.Info("Schema collection time", "schema", timing.schema, "elapsed", timing.end.Sub(timing.start), "tables", timing.tables)
+	}
+}
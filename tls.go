@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// tlsConfigName is the name the custom TLS config is registered under in the
+// MySQL driver.
+const tlsConfigName = "force-rebase"
+
+// registerTLSConfig builds a TLS config from the given CA and client
+// certificate files and registers it to the MySQL driver. Returns the name to
+// be used in the `tls` DSN parameter.
+func registerTLSConfig(caFile, certFile, keyFile string, skipVerify bool) (string, error) {
+	if (certFile == "") != (keyFile == "") {
+		return "", errors.New("-tls-cert and -tls-key must be provided together")
+	}
+
+	config := &tls.Config{InsecureSkipVerify: skipVerify}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return "", fmt.Errorf("reading CA file: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return "", fmt.Errorf("no certificates found in CA file '%s'", caFile)
+		}
+	}
+
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return "", fmt.Errorf("loading client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if err := mysql.RegisterTLSConfig(tlsConfigName, config); err != nil {
+		return "", fmt.Errorf("registering TLS config: %w", err)
+	}
+	return tlsConfigName, nil
+}